@@ -27,13 +27,14 @@ import (
 	"fmt"
 	"github.com/cbocovic/chord"
 	"io"
+	"strings"
 )
 
 func main() {
 
 	//set up flags
 	addressPtr := flag.String("addr", "127.0.0.1:8888", "the port you will listen on for incomming messages")
-	joinPtr := flag.String("join", "", "an address of a server in the Chord network to join to")
+	joinPtr := flag.String("join", "", "a comma-separated list of addresses of servers in the Chord network to join to")
 
 	flag.Parse()
 	me := new(chord.ChordNode)
@@ -42,7 +43,13 @@ func main() {
 	if *joinPtr == "" {
 		me = chord.Create(*addressPtr)
 	} else {
-		me = chord.Join(*addressPtr, *joinPtr)
+		var err error
+		me, err = chord.Join(*addressPtr, strings.Split(*joinPtr, ","))
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			return
+		}
+		fmt.Printf("Joined through %s.\n", me.Seed())
 	}
 	fmt.Printf("My address is: %s.\n", *addressPtr)
 	//block until receive input
@@ -53,7 +60,7 @@ Loop:
 		switch {
 		case cmd == "print":
 			//print out successor and predecessor
-			fmt.Printf("%s", me.Info())
+			fmt.Printf("%s", me.String())
 		case cmd == "fingers":
 			//print out finger table
 			fmt.Printf("%s", me.ShowFingers())
@@ -34,36 +34,65 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"sync"
 	"time"
 )
 
+//ID is an identifier on the Chord ring. Identifiers of rings with fewer than
+//256 bits are stored in the low-order bits.
+type ID [sha256.Size]byte
+
+//String returns the identifier in hexadecimal.
+func (id ID) String() string {
+	return fmt.Sprintf("%x", id[:])
+}
+
 //Finger type denoting identifying information about a ChordNode
 type Finger struct {
-	id     [sha256.Size]byte
+	id     ID
 	ipaddr string
 }
 
-type request struct {
-	write bool
-	succ  bool
-	index int
-}
-
 //ChordNode type denoting a Chord server.
 type ChordNode struct {
-	predecessor   *Finger
-	successor     *Finger
-	successorList [sha256.Size * 8]Finger
-	fingerTable   [sha256.Size*8 + 1]Finger
-
-	finger  chan Finger
-	request chan request
+	table *routingTable
 
-	id     [sha256.Size]byte
+	id     ID
 	ipaddr string
-
-	connections  map[string]net.TCPConn
+	bits   int
+	config Config
+
+	seeds    []string
+	seed     string
+	isolated bool
+	restored bool
+	joinLock sync.Mutex
+
+	peers     map[string]Finger
+	peersLock sync.Mutex
+	//suspect is the remembered peer the last probe found in another ring,
+	//which is probed again before the rings are merged
+	suspect string
+
+	detector          *detector
+	stabilizeSchedule *schedule
+	fixSchedule       *schedule
+
+	subscribers subscribers
+
+	connections  map[string]*peerConn
+	inbound      map[net.Conn]bool
+	listener     *net.TCPListener
+	connLock     sync.Mutex
 	applications map[byte]ChordApp
+	appLock      sync.RWMutex
+
+	//ready is closed once the node is part of a ring, and done once it is
+	//finalized
+	ready     chan struct{}
+	readyOnce sync.Once
+	done      chan struct{}
+	stopOnce  sync.Once
 
 	//testing purposes only
 	malicious byte
@@ -90,6 +119,9 @@ func checkError(err error) {
 //Chord node, start, this function will request the finger tables of
 //the closest preceeding Chord node to key until the successor is found.
 //
+//The key is reduced to the identifier space of the ring before the lookup,
+//so full SHA-256 digests may be used as keys in rings of any size.
+//
 //If the start address is unreachable, the error is of type PeerError.
 func Lookup(key [sha256.Size]byte, start string) (addr string, err error) {
 
@@ -102,11 +134,14 @@ func Lookup(key [sha256.Size]byte, start string) (addr string, err error) {
 		return
 	}
 
-	ft, err := parseFingers(reply)
+	ft, bits, err := parseFingerTable(reply)
 	if err != nil {
 		err = &PeerError{start, err}
 		return
 	}
+	if bits > 0 {
+		key = reduce(key, bits)
+	}
 	if len(ft) < 2 {
 		return
 	}
@@ -172,11 +207,92 @@ func Lookup(key [sha256.Size]byte, start string) (addr string, err error) {
 	return
 }
 
-//Lookup returns the address of the ChordNode that is responsible
+//Lookup returns the address of the ChordNode that is responsible for key,
+//starting the lookup at the node itself. The node answers for itself only if
+//its predecessor is known and key lies between the two, and for its successor
+//if key lies between the node and its successor; otherwise the lookup is
+//forwarded to its successor. A node without a successor is alone on the ring
+//and responsible for every key.
+func (node *ChordNode) Lookup(key ID) (addr string, err error) {
+	successor := node.Successor()
+	if successor.zero() {
+		return node.ipaddr, nil
+	}
+	key = reduce(key, node.bits)
+	pred := node.Predecessor()
+	if !pred.zero() && (Range{pred.id, node.id}).Contains(key) {
+		return node.ipaddr, nil
+	}
+	if (Range{node.id, successor.id}).Contains(key) {
+		return successor.ipaddr, nil
+	}
+	return node.lookup(key, successor.ipaddr)
+}
+
+//LookupSuccessors returns the addresses of up to n distinct nodes that
+//succeed key on the ring: the node responsible for key, followed by the
+//entries of its successor list. Fewer addresses are returned if the ring is
+//smaller than n or the successor lists are shorter.
+func (node *ChordNode) LookupSuccessors(key ID, n int) (addrs []string, err error) {
+	owner, err := node.Lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	addrs = []string{owner}
+	if n <= 1 {
+		return
+	}
+
+	var successors []Finger
+	if owner == node.ipaddr {
+		successors = node.SuccessorList()
+	} else {
+		reply, err := node.send(getsuccessorsMsg(), owner)
+		if err != nil {
+			return nil, &PeerError{owner, err}
+		}
+		if successors, err = parseFingers(reply); err != nil {
+			return nil, &PeerError{owner, err}
+		}
+	}
+	for _, f := range successors {
+		if len(addrs) == n {
+			break
+		}
+		if f.zero() || f.ipaddr == owner {
+			continue
+		}
+		duplicate := false
+		for _, addr := range addrs {
+			duplicate = duplicate || addr == f.ipaddr
+		}
+		if !duplicate {
+			addrs = append(addrs, f.ipaddr)
+		}
+	}
+	return
+}
+
+//SendApp sends data to the application registered with the identifier app on
+//the Chord node at addr and returns the application's reply. Applications
+//must reply to every message with at least one byte.
+func (node *ChordNode) SendApp(app byte, data []byte, addr string) (reply []byte, err error) {
+	if app == 1 {
+		return nil, fmt.Errorf("application identifier 1 is reserved for Chord")
+	}
+	reply, err = node.send(appMsg(app, data), addr)
+	if err != nil {
+		err = &PeerError{addr, err}
+	}
+	return
+}
+
+//lookup returns the address of the ChordNode that is responsible
 //for the key. The procedure begins at the address denoted by start.
 func (node *ChordNode) lookup(key [sha256.Size]byte, start string) (addr string, err error) {
 
 	addr = start
+	key = reduce(key, node.bits)
 
 	msg := getfingersMsg()
 	reply, err := node.send(msg, start)
@@ -207,6 +323,9 @@ func (node *ChordNode) lookup(key [sha256.Size]byte, start string) (addr string,
 		if i == 0 {
 			break
 		}
+		if node.Suspect(f.ipaddr) { //route around peers that seem to have failed
+			continue
+		}
 		if InRange(f.id, current.id, key) { //see if f.id is closer than I am.
 			addr, err = node.lookup(key, f.ipaddr)
 			if err != nil { //node failed
@@ -255,160 +374,363 @@ func (node *ChordNode) lookup(key [sha256.Size]byte, start string) (addr string,
 }
 
 //Create will start a new Chord DHT and return the original ChordNode
-func Create(myaddr string) *ChordNode {
+func Create(myaddr string, opts ...Option) *ChordNode {
+	node := create(myaddr, nil, opts)
+	node.joined()
+	return node
+}
+
+//create starts a new ChordNode that remembers the given seeds
+func create(myaddr string, seeds []string, opts []Option) *ChordNode {
+	cfg := newConfig(opts)
 	node := new(ChordNode)
 	//initialize node information
-	node.id = sha256.Sum256([]byte(myaddr))
+	node.config = cfg
+	node.seeds = seeds
+	node.bits = cfg.Bits
+	node.id = reduce(sha256.Sum256([]byte(myaddr)), node.bits)
 	node.ipaddr = myaddr
 	me := new(Finger)
 	me.id = node.id
 	me.ipaddr = node.ipaddr
-	node.fingerTable[0] = *me
-	succ := new(Finger)
-	node.successor = succ
-	pred := new(Finger)
-	node.predecessor = pred
+	node.table = newRoutingTable(*me, node.bits, cfg.Successors)
 
-	//set up channels for finger manager
-	c := make(chan Finger)
-	c2 := make(chan request)
-	node.finger = c
-	node.request = c2
+	node.connections = make(map[string]*peerConn)
+	node.inbound = make(map[net.Conn]bool)
+	node.ready = make(chan struct{})
+	node.done = make(chan struct{})
+	node.applications = make(map[byte]ChordApp)
+	node.peers = make(map[string]Finger)
+	node.subscribers.subs = make(map[*Subscription]bool)
+	for _, s := range cfg.Subscriptions {
+		node.attach(s)
+	}
+	node.detector = newDetector(cfg.PhiThreshold)
+	node.stabilizeSchedule = newSchedule(cfg.StabilizeInterval, cfg)
+	node.fixSchedule = newSchedule(cfg.FixInterval, cfg)
 
 	//initialize listener and network manager threads
 	node.listen(myaddr)
-	node.connections = make(map[string]net.TCPConn)
-	node.applications = make(map[byte]ChordApp)
 
-	//initialize maintenance and finger manager threads
-	go node.data()
-	go node.maintain()
+	//initialize maintenance threads
+	if cfg.StateFile != "" {
+		node.restored = node.restoreState()
+	}
+	if !cfg.Manual {
+		go node.maintain()
+	}
 	return node
 }
 
 //Join will add a new ChordNode to an existing DHT. It looks up the successor
-//of the new node starting at an existing Chord node specified by addr. Join
-//returns the new ChordNode when completed.
+//of the new node starting at one of the existing Chord nodes given in seeds.
+//If the node was created with WithStateFile and resumed from its saved
+//routing state, the seeds are not contacted.
+//The seeds are tried in a random order; if none of them can be used, Join
+//waits and tries them all again, backing off exponentially, until the number
+//of attempts set by WithJoinRetry is exhausted. Join returns the new ChordNode
+//when completed and Seed reports which seed was used. The options must
+//describe the same identifier space as the rest of the ring.
 //
-//If the start address is unreachable, the error is of type PeerError.
-func Join(myaddr string, addr string) (*ChordNode, error) {
-	node := Create(myaddr)
-	successor, err := Lookup(node.id, addr)
+//If the node was created with WithBackgroundJoin, Join returns as soon as the
+//first attempt fails, before the node is part of the ring, and keeps retrying
+//in the background until the node has joined. The channel returned by Ready
+//is closed once it has.
+//
+//If none of the seeds can be used, the node stops listening and the error is
+//of type JoinError.
+func Join(myaddr string, seeds []string, opts ...Option) (*ChordNode, error) {
+	node := create(myaddr, seeds, opts)
+	if node.restored {
+		node.joined()
+		return node, nil
+	}
+
+	backoff := node.config.JoinBackoff
+	for attempt := 1; ; attempt++ {
+		err := node.joinSeeds(seeds)
+		if err == nil {
+			return node, nil
+		}
+		if node.config.JoinInBackground {
+			go node.joinLoop(seeds, backoff)
+			return node, nil
+		}
+		if attempt >= node.config.JoinAttempts {
+			node.stop()
+			return nil, err
+		}
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff, node.config.JoinMaxBackoff)
+	}
+}
+
+//JoinError is returned by Join when the node could not join the ring through
+//any of its seeds. Errors holds the failure of each seed in the last attempt.
+type JoinError struct {
+	Errors []error
+}
+
+func (e *JoinError) Error() string {
+	return fmt.Sprintf("Failed to join through any of %d seeds. Last cause of failure: %v.", len(e.Errors), e.last())
+}
+
+func (e *JoinError) last() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e.Errors[len(e.Errors)-1]
+}
+
+//joinLoop retries joining through the seeds until it succeeds or the node is
+//finalized
+func (node *ChordNode) joinLoop(seeds []string, backoff time.Duration) {
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-node.done:
+			return
+		}
+		err := node.joinSeeds(seeds)
+		if err == nil {
+			return
+		}
+		checkError(err)
+		backoff = nextBackoff(backoff, node.config.JoinMaxBackoff)
+	}
+}
+
+//joinSeeds tries each of the seeds in a random order until one of them can be
+//used to join the ring
+func (node *ChordNode) joinSeeds(seeds []string) error {
+	jerr := new(JoinError)
+	for _, i := range rand.Perm(len(seeds)) {
+		seed := seeds[i]
+		if seed == node.ipaddr {
+			continue
+		}
+		err := node.join(seed)
+		if err == nil {
+			node.joinLock.Lock()
+			node.seed = seed
+			node.joinLock.Unlock()
+			node.emit(Event{Type: Joined, Peer: Finger{ipaddr: seed}})
+			node.joined()
+			return nil
+		}
+		jerr.Errors = append(jerr.Errors, err)
+	}
+	return jerr
+}
+
+//join looks up the node's successor starting at addr. Like every message of
+//the node, those sent to join are bounded by its timeout.
+func (node *ChordNode) join(addr string) error {
+	successor, err := node.lookup(node.id, addr)
 	if err != nil || successor == "" {
-		return nil, &PeerError{addr, err}
+		return &PeerError{addr, err}
+	}
+	if successor == node.ipaddr {
+		//the ring still routes our identifier to us. Start from addr
+		//and let stabilization find the true successor.
+		successor = addr
 	}
 
 	//find id of node
 	msg := getidMsg()
-	reply, err := Send(msg, successor)
+	reply, err := node.send(msg, successor)
 	if err != nil {
-		return nil, &PeerError{addr, err}
+		return &PeerError{addr, err}
 	}
 
 	//update node info to include successor
 	succ := new(Finger)
 	succ.id, err = parseId(reply)
 	if err != nil {
-		return nil, &PeerError{addr, err}
+		return &PeerError{addr, err}
 	}
 	succ.ipaddr = successor
-	node.query(true, false, 1, succ)
+	node.setSuccessor(*succ)
 
-	return node, nil
+	return nil
 }
 
-//data manages reads and writes to the node data structure
-func (node *ChordNode) data() {
-	for {
-		req := <-node.request
-		if req.write {
-			if req.succ {
-				node.successorList[req.index] = <-node.finger
-			} else {
-				if req.index < 0 {
-					*node.predecessor = <-node.finger
-				} else if req.index == 1 {
-					*node.successor = <-node.finger
-					node.fingerTable[1] = *node.successor
-					node.successorList[0] = *node.successor
-				} else {
-					node.fingerTable[req.index] = <-node.finger
-				}
-			}
-		} else { //req.read
-			if req.succ {
-				node.finger <- node.successorList[req.index]
-			} else {
-				if req.index < 0 {
-					node.finger <- *node.predecessor
-				} else {
-					node.finger <- node.fingerTable[req.index]
-				}
-			}
+//rejoin tries to reconnect an isolated node to the ring, first through its
+//seeds and then through the peers it remembers from its finger table and
+//predecessor.
+func (node *ChordNode) rejoin() {
+	var candidates []string
+	seen := make(map[string]bool)
+	seen[node.ipaddr] = true
+	add := func(addr string) {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			candidates = append(candidates, addr)
 		}
 	}
-}
+	for _, i := range rand.Perm(len(node.seeds)) {
+		add(node.seeds[i])
+	}
+	for _, f := range node.Fingers()[2:] {
+		add(f.ipaddr)
+	}
+	add(node.Predecessor().ipaddr)
 
-//query allows functions to read from or write to the node object
-func (node *ChordNode) query(write bool, succ bool, index int, newf *Finger) Finger {
-	f := new(Finger)
-	req := request{write, succ, index}
-	node.request <- req
-	if write {
-		node.finger <- *newf
-	} else {
-		*f = <-node.finger
+	for _, addr := range candidates {
+		if err := node.join(addr); err != nil {
+			continue
+		}
+		node.joinLock.Lock()
+		node.isolated = false
+		node.joinLock.Unlock()
+		if node.config.Rejoined != nil {
+			node.config.Rejoined(addr)
+		}
+		node.emit(Event{Type: Joined, Peer: Finger{ipaddr: addr}})
+		return
 	}
+}
+
+//joined records that the node is part of a ring
+func (node *ChordNode) joined() {
+	node.readyOnce.Do(func() {
+		close(node.ready)
+	})
+}
 
-	return *f
+//Ready returns a channel that is closed once the node is part of a ring: right
+//away for nodes started with Create or joined in the foreground, and once the
+//background join succeeded for nodes started with WithBackgroundJoin.
+func (node *ChordNode) Ready() <-chan struct{} {
+	return node.ready
 }
 
-//maintain will periodically perform maintenance operations
+//Isolated returns true if the node lost all of its successors and has not yet
+//managed to rejoin the ring.
+func (node *ChordNode) Isolated() bool {
+	node.joinLock.Lock()
+	defer node.joinLock.Unlock()
+	return node.isolated
+}
+
+//Seed returns the address of the seed through which the node joined the ring,
+//or an empty string if the node has not joined through a seed.
+func (node *ChordNode) Seed() string {
+	node.joinLock.Lock()
+	defer node.joinLock.Unlock()
+	return node.seed
+}
+
+//nextBackoff doubles the backoff, up to max
+func nextBackoff(backoff time.Duration, max time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+//maintain starts the periodic maintenance operations. Each operation runs in
+//its own loop at the interval set in the node's configuration.
 func (node *ChordNode) maintain() {
+	go node.every(node.stabilizeSchedule.interval, func() {
+		before := node.SuccessorList()
+		node.stabilize()
+		node.stabilizeSchedule.update(!sameFingers(before, node.SuccessorList()))
+		if node.config.StateFile != "" {
+			checkError(node.saveState())
+		}
+	})
+	go node.every(fixed(node.config.CheckPredInterval), node.checkPred)
+	go node.every(fixed(node.config.PartitionInterval), node.checkPartition)
+
 	ctr := 0
+	node.every(node.fixSchedule.interval, func() {
+		changed := false
+		for i := 0; i < node.config.FixBatch; i++ {
+			if node.fix(ctr) {
+				changed = true
+			}
+			ctr = ctr % node.bits
+			ctr += 1
+		}
+		node.fixSchedule.update(changed)
+	})
+}
+
+//every calls f repeatedly, sleeping for the interval returned by next, give or
+//take the configured jitter, before each call, until the node is finalized
+func (node *ChordNode) every(next func() time.Duration, f func()) {
 	for {
-		time.Sleep(time.Duration(rand.Uint32()%3)*time.Minute + time.Duration(rand.Uint32()%60)*time.Second + time.Duration(rand.Uint32()%60)*time.Millisecond)
-		//stabilize
-		node.stabilize()
-		//check predecessor
-		node.checkPred()
-		//update fingers
-		node.fix(ctr)
-		ctr = ctr % 256
-		ctr += 1
+		select {
+		case <-time.After(jitter(next(), node.config.Jitter)):
+			f()
+		case <-node.done:
+			return
+		}
+	}
+}
+
+//fixed returns an interval function for every that always returns d
+func fixed(d time.Duration) func() time.Duration {
+	return func() time.Duration {
+		return d
+	}
+}
+
+//jitter returns a random duration in [d - j*d, d + j*d)
+func jitter(d time.Duration, j float64) time.Duration {
+	if j <= 0 || d <= 0 {
+		return d
 	}
+	return d + time.Duration((rand.Float64()*2-1)*j*float64(d))
 }
 
 //stablize ensures that the node's successor's predecessor is itself
 //If not, it updates its successor's predecessor.
 func (node *ChordNode) stabilize() {
-	successor := node.query(false, false, 1, nil)
+	defer node.pruneDetector()
+	successor := node.Successor()
 
 	if successor.zero() {
+		if node.Isolated() {
+			node.rejoin()
+		}
 		return
 	}
 
 	//check to see if successor is still around
 	msg := pingMsg()
 	reply, err := node.send(msg, successor.ipaddr)
+	if err != nil && !node.Suspect(successor.ipaddr) {
+		//probably a transient failure, keep the successor for now
+		return
+	}
 	if err != nil {
 		//successor failed to respond
-		//check in successor list for next available successor.
-		for i := 1; i < sha256.Size*8; i++ {
-			successor = node.query(false, true, i, nil)
-			if successor.ipaddr == node.ipaddr {
+		node.emit(Event{Type: PeerFailed, Peer: successor})
+		//check in successor list for next available successor. If there
+		//is none, the successor is cleared.
+		successors := node.SuccessorList()
+		successor = Finger{}
+		for _, f := range successors[1:] {
+			if f.zero() || f.ipaddr == node.ipaddr || node.Suspect(f.ipaddr) {
 				continue
 			}
 			msg := pingMsg()
-			reply, err = node.send(msg, successor.ipaddr)
-			if err == nil {
+			if _, err = node.send(msg, f.ipaddr); err == nil {
+				successor = f
 				break
-			} else {
-				successor.ipaddr = ""
 			}
+			node.emit(Event{Type: PeerFailed, Peer: f})
 		}
-		node.query(true, false, 1, &successor)
-		if successor.ipaddr == "" {
+		node.setSuccessor(successor)
+		if successor.zero() {
+			//every successor failed, the node is cut off from the ring
+			node.joinLock.Lock()
+			node.isolated = true
+			node.joinLock.Unlock()
+			node.rejoin()
 			return
 		}
 	}
@@ -423,11 +745,7 @@ func (node *ChordNode) stabilize() {
 	if err != nil {
 		return
 	}
-	for i := range ft {
-		if i < sha256.Size*8-1 {
-			node.query(true, true, i+1, &ft[i])
-		}
-	}
+	node.setSuccessorList(ft)
 
 	//ask sucessor for predecessor
 	msg = getpredMsg()
@@ -443,7 +761,7 @@ func (node *ChordNode) stabilize() {
 	if predOfSucc.ipaddr != "" {
 		if predOfSucc.id != node.id {
 			if InRange(predOfSucc.id, node.id, successor.id) {
-				node.query(true, false, 1, &predOfSucc)
+				node.setSuccessor(predOfSucc)
 			}
 		} else { //everything is fine
 			return
@@ -454,7 +772,7 @@ func (node *ChordNode) stabilize() {
 	me := new(Finger)
 	me.id = node.id
 	me.ipaddr = node.ipaddr
-	msg = claimpredMsg(*me)
+	msg = claimpredMsg(*me, node.bits)
 	node.send(msg, successor.ipaddr)
 
 }
@@ -463,9 +781,16 @@ func (node *ChordNode) stabilize() {
 //and messages through the Chord DHT.
 //
 //A Chord node registers an application app and forwards all messages with the
-//identifier id by calling the interface method Message. Applications will also
-//be notified of any changes in the underlying node's predecessor.
+//identifier id by calling the interface method Message. The identifier 1 is
+//reserved for Chord's own messages. Applications will also
+//be notified of any changes in the underlying node's predecessor. Applications
+//that implement RangeApp are also told which keys the node gained or lost.
 func (node *ChordNode) Register(id byte, app ChordApp) bool {
+	if id == 1 {
+		return false
+	}
+	node.appLock.Lock()
+	defer node.appLock.Unlock()
 	if _, ok := node.applications[id]; ok {
 		return false
 	}
@@ -474,56 +799,111 @@ func (node *ChordNode) Register(id byte, app ChordApp) bool {
 
 }
 
+//app returns the application registered with the identifier id
+func (node *ChordNode) app(id byte) (app ChordApp, ok bool) {
+	node.appLock.RLock()
+	defer node.appLock.RUnlock()
+	app, ok = node.applications[id]
+	return
+}
+
+//apps returns every registered application
+func (node *ChordNode) apps() []ChordApp {
+	node.appLock.RLock()
+	defer node.appLock.RUnlock()
+	apps := make([]ChordApp, 0, len(node.applications))
+	for _, app := range node.applications {
+		apps = append(apps, app)
+	}
+	return apps
+}
+
 func (node *ChordNode) notify(newPred Finger) {
-	node.query(true, false, -1, &newPred)
+	node.setPredecessor(newPred)
 	//update predecessor
-	successor := node.query(false, false, 1, nil)
+	successor := node.Successor()
 	if successor.zero() { //TODO: so if you get here, you were probably the first node.
-		node.query(true, false, 1, &newPred)
+		node.setSuccessor(newPred)
 	}
 	//notify applications
-	for _, app := range node.applications {
+	for _, app := range node.apps() {
 		app.Notify(newPred.id, node.id, newPred.ipaddr)
 	}
 }
 
+//checkPred checks that the predecessor is still alive and refreshes the
+//predecessor list from the predecessor's own list. If the predecessor failed,
+//the next live node of the predecessor list takes its place.
 func (node *ChordNode) checkPred() {
-	predecessor := node.query(false, false, -1, nil)
+	predecessor := node.Predecessor()
 	if predecessor.zero() {
 		return
 	}
 
 	msg := pingMsg()
 	reply, err := node.send(msg, predecessor.ipaddr)
+	if err == nil {
+		if success, perr := parsePong(reply); !success || perr != nil {
+			err = &PeerError{predecessor.ipaddr, perr}
+		}
+	}
+	if err != nil && !node.Suspect(predecessor.ipaddr) {
+		//probably a transient failure, keep the predecessor for now
+		return
+	}
 	if err != nil {
+		//predecessor failed, fall back on the predecessor list
+		node.emit(Event{Type: PeerFailed, Peer: predecessor})
+		predecessors := node.PredecessorList()
+		for i := 1; i < len(predecessors); i++ {
+			f := predecessors[i]
+			if f.zero() || f.ipaddr == node.ipaddr || node.Suspect(f.ipaddr) {
+				continue
+			}
+			msg = pingMsg()
+			if _, err = node.send(msg, f.ipaddr); err == nil {
+				node.notify(f)
+				return
+			}
+		}
 		predecessor.ipaddr = ""
-		node.query(true, false, -1, &predecessor)
+		node.setPredecessor(predecessor)
+		return
 	}
 
-	if success, err := parsePong(reply); !success || err != nil {
-		predecessor.ipaddr = ""
-		node.query(true, false, -1, &predecessor)
+	//update predecessor list
+	msg = getpredecessorsMsg()
+	reply, err = node.send(msg, predecessor.ipaddr)
+	if err != nil {
+		return
 	}
-
-	return
-
+	ft, err := parseFingers(reply)
+	if err != nil {
+		return
+	}
+	node.setPredecessorList(ft)
 }
 
-func (node *ChordNode) fix(which int) {
-	successor := node.query(false, false, 1, nil)
+//fix refreshes the finger at index which. It returns true if the finger
+//changed or could not be refreshed because a peer failed.
+func (node *ChordNode) fix(which int) (changed bool) {
+	successor := node.Successor()
 	if which == 0 || which == 1 || successor.zero() {
 		return
 	}
 	var targetId [sha256.Size]byte
-	copy(targetId[:sha256.Size], target(node.id, which)[:sha256.Size])
+	copy(targetId[:sha256.Size], target(node.id, which, node.bits)[:sha256.Size])
 	newip, err := node.lookup(targetId, successor.ipaddr)
 	if err != nil { //node failed: TODO make more robust
 		checkError(err)
-		return
+		return true
 	}
 	if newip == node.ipaddr {
-		checkError(err)
-		return
+		//the node succeeds the target itself, fingers never point back
+		//at the node
+		old := node.finger(which)
+		node.setFinger(which, Finger{})
+		return !old.zero()
 	}
 
 	//find id of node
@@ -531,24 +911,34 @@ func (node *ChordNode) fix(which int) {
 	reply, err := node.send(msg, newip)
 	if err != nil {
 		checkError(err)
-		return
+		return true
 	}
 
 	newfinger := new(Finger)
 	newfinger.ipaddr = newip
 	newfinger.id, _ = parseId(reply)
-	node.query(true, false, which, newfinger)
+	old := node.finger(which)
+	node.setFinger(which, *newfinger)
 
+	return old != *newfinger
 }
 
 //Finalize stops all communication and removes the ChordNode from the DHT.
 func (node *ChordNode) Finalize() {
 	//send message to all children to terminate
+	if node.config.StateFile != "" {
+		checkError(node.saveState())
+	}
+	me := Finger{node.id, node.ipaddr}
+	node.emit(Event{Type: Left, Peer: me})
+	node.closeSubscriptions()
+	node.stop()
 
 	fmt.Printf("Exiting...\n")
 }
 
 //InRange is a helper function that returns true if the value x is between the values (min, max)
+//on the identifier circle. All three values must lie in the same identifier space.
 func InRange(x [sha256.Size]byte, min [sha256.Size]byte, max [sha256.Size]byte) bool {
 	//There are 3 cases: min < x and x < max,
 	//x < max and max < min, max < min and min < x
@@ -574,54 +964,81 @@ func InRange(x [sha256.Size]byte, min [sha256.Size]byte, max [sha256.Size]byte)
 	return false
 }
 
-//target returns the target id used by the fix function
-func target(me [sha256.Size]byte, which int) []byte {
+//target returns the target id used by the fix function: me + 2^(which-1) mod 2^bits
+func target(me [sha256.Size]byte, which int, bits int) []byte {
 	meint := new(big.Int)
 	meint.SetBytes(me[:sha256.Size])
 
-	baseint := new(big.Int)
-	baseint.SetUint64(2)
+	target := new(big.Int)
+	target.Lsh(big.NewInt(1), uint(which-1))
+	target.Add(meint, target)
+	target.Mod(target, modulus(bits))
+
+	var bytes [sha256.Size]byte
+	target.FillBytes(bytes[:])
+	return bytes[:sha256.Size]
+}
 
-	powint := new(big.Int)
-	powint.SetInt64(int64(which - 1))
+//modulus returns 2^bits, the size of the identifier space
+func modulus(bits int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits))
+}
 
-	var biggest [sha256.Size + 1]byte
-	for i := range biggest {
-		biggest[i] = 255
+//reduce maps an identifier into an identifier space of the given number of bits
+func reduce(id [sha256.Size]byte, bits int) [sha256.Size]byte {
+	if bits >= sha256.Size*8 {
+		return id
 	}
+	idint := new(big.Int)
+	idint.SetBytes(id[:sha256.Size])
+	idint.Mod(idint, modulus(bits))
+	var reduced [sha256.Size]byte
+	idint.FillBytes(reduced[:])
+	return reduced
+}
 
-	tmp := new(big.Int)
-	tmp.SetInt64(1)
+//idLen returns the number of bytes used to encode an identifier of the given
+//number of bits on the wire
+func idLen(bits int) int {
+	return (bits + 7) / 8
+}
 
-	modint := new(big.Int)
-	modint.SetBytes(biggest[:sha256.Size])
-	modint.Add(modint, tmp)
+//ID returns the node's identifier.
+func (node *ChordNode) ID() ID {
+	return node.id
+}
 
-	target := new(big.Int)
-	target.Exp(baseint, powint, modint)
-	target.Add(meint, target)
-	target.Mod(target, modint)
+//Addr returns the address the node listens on.
+func (node *ChordNode) Addr() string {
+	return node.ipaddr
+}
 
-	bytes := target.Bytes()
-	diff := sha256.Size - len(bytes)
-	if diff > 0 {
-		tmp := make([]byte, sha256.Size)
-		//pad with zeros
-		for i := 0; i < diff; i++ {
-			tmp[i] = 0
-		}
-		for i := diff; i < sha256.Size; i++ {
-			tmp[i] = bytes[i-diff]
-		}
-		bytes = tmp
-	}
-	return bytes[:sha256.Size]
+//Bits returns the size m of the node's identifier space.
+func (node *ChordNode) Bits() int {
+	return node.bits
+}
+
+//Reduce maps key, for example a full SHA-256 digest, into the node's
+//identifier space, so that it can be compared with node identifiers and
+//ranges.
+func (node *ChordNode) Reduce(key ID) ID {
+	return reduce(key, node.bits)
 }
 
 func (f Finger) String() string {
 	return fmt.Sprintf("%s", f.ipaddr)
 }
 
+//ID returns the identifier of the node the finger points to.
+func (f Finger) ID() ID {
+	return f.id
+}
+
+//Addr returns the address of the node the finger points to.
+func (f Finger) Addr() string {
+	return f.ipaddr
+}
+
 func (f Finger) zero() bool {
 	if f.ipaddr == "" {
 		return true
@@ -635,8 +1052,9 @@ func (f Finger) zero() bool {
 //String returns a string containing the node's ip address, sucessor, and predecessor.
 func (node *ChordNode) String() string {
 	var succ, pred string
-	successor := node.query(false, false, 1, nil)
-	predecessor := node.query(false, false, -1, nil)
+	snapshot := node.Snapshot()
+	successor := snapshot.Successors[0]
+	predecessor := snapshot.Predecessor
 	if !successor.zero() {
 		succ = successor.String()
 	} else {
@@ -656,8 +1074,9 @@ func (node *ChordNode) ShowFingers() string {
 	finger := new(Finger)
 	prevfinger := new(Finger)
 	ctr := 0
-	for i := 0; i < sha256.Size*8+1; i++ {
-		*finger = node.query(false, false, i, nil)
+	fingers := node.Fingers()
+	for i := 0; i < len(fingers); i++ {
+		*finger = fingers[i]
 		if !finger.zero() {
 			ctr += 1
 			if i == 0 || finger.ipaddr != prevfinger.ipaddr {
@@ -669,13 +1088,32 @@ func (node *ChordNode) ShowFingers() string {
 	return retval + fmt.Sprintf("Total fingers: %d.\n", ctr)
 }
 
+//ShowPred returns a string representation of the ChordNode's predecessor list.
+func (node *ChordNode) ShowPred() string {
+	table := ""
+	finger := new(Finger)
+	prevfinger := new(Finger)
+	predecessors := node.PredecessorList()
+	for i := 0; i < len(predecessors); i++ {
+		*finger = predecessors[i]
+		if finger.ipaddr != "" {
+			if i == 0 || finger.ipaddr != prevfinger.ipaddr {
+				table += fmt.Sprintf("%s\n", finger.String())
+			}
+		}
+		*prevfinger = *finger
+	}
+	return table
+}
+
 //ShowSucc returns a string representation of the ChordNode's successor list.
 func (node *ChordNode) ShowSucc() string {
 	table := ""
 	finger := new(Finger)
 	prevfinger := new(Finger)
-	for i := 0; i < sha256.Size*8; i++ {
-		*finger = node.query(false, true, i, nil)
+	successors := node.SuccessorList()
+	for i := 0; i < len(successors); i++ {
+		*finger = successors[i]
 		if finger.ipaddr != "" {
 			if i == 0 || finger.ipaddr != prevfinger.ipaddr {
 				table += fmt.Sprintf("%s\n", finger.String())
@@ -694,6 +1132,7 @@ type ChordApp interface {
 	//Notify will alert the application of changes in the ChordNode's predecessor
 	Notify(id [sha256.Size]byte, me [sha256.Size]byte, addr string)
 
-	//Message will forward a message that was received through the DHT to the application
+	//Message will forward a message that was received through the DHT to the application.
+	//Messages are forwarded as they arrive, so Message may be called concurrently.
 	Message(data []byte) []byte
 }
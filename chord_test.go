@@ -0,0 +1,324 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//listening returns true if a node accepts connections at addr
+func listening(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func TestJoinFailureStops(t *testing.T) {
+	addr := "127.0.0.1:19220"
+	opts := append(testOptions(8), WithJoinRetry(2, 10*time.Millisecond, 10*time.Millisecond))
+	node, err := Join(addr, []string{"127.0.0.1:19221"}, opts...)
+	if _, ok := err.(*JoinError); !ok || node != nil {
+		t.Fatalf("Join through a seed that is down returned %v, %v", node, err)
+	}
+	if listening(addr) {
+		t.Errorf("the node still listens after failing to join")
+	}
+	//the address can be used again
+	node = Create(addr, testOptions(8)...)
+	defer node.Finalize()
+	if !listening(addr) {
+		t.Errorf("a new node cannot listen on the address")
+	}
+}
+
+func TestJoinSilentSeed(t *testing.T) {
+	//the seed accepts connections but never replies
+	listener, err := net.Listen("tcp", "127.0.0.1:19225")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	opts := append(testOptions(8), WithTimeout(100*time.Millisecond), WithJoinRetry(2, 10*time.Millisecond, 10*time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		node, err := Join("127.0.0.1:19224", []string{listener.Addr().String()}, opts...)
+		if node != nil {
+			node.Finalize()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if _, ok := err.(*JoinError); !ok {
+			t.Errorf("Join through a silent seed returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Join through a silent seed did not time out")
+	}
+}
+
+func TestBackgroundJoinReady(t *testing.T) {
+	seed := "127.0.0.1:19223"
+	opts := append(testOptions(8), WithBackgroundJoin(), WithJoinRetry(1, 20*time.Millisecond, 50*time.Millisecond))
+	node, err := Join("127.0.0.1:19222", []string{seed}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Finalize()
+	select {
+	case <-node.Ready():
+		t.Fatal("Ready before the seed is up")
+	default:
+	}
+
+	first := Create(seed, testOptions(8)...)
+	defer first.Finalize()
+	select {
+	case <-node.Ready():
+	case <-time.After(10 * time.Second):
+		t.Fatal("the node did not join once the seed was up")
+	}
+	if node.Seed() != seed {
+		t.Errorf("joined through %q", node.Seed())
+	}
+	select {
+	case <-first.Ready():
+	default:
+		t.Errorf("a node started with Create is not ready")
+	}
+}
+
+func TestFinalizeLeavesRing(t *testing.T) {
+	const bits = 8
+	addrs := testAddrs(19230, 4, bits)
+	nodes := []*ChordNode{Create(addrs[0], testOptions(bits)...)}
+	defer func() {
+		for _, node := range nodes {
+			node.Finalize()
+		}
+	}()
+	for _, addr := range addrs[1:] {
+		node, err := Join(addr, []string{addrs[0]}, testOptions(bits)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	converge(t, nodes)
+
+	gone := nodes[2]
+	nodes = append(nodes[:2], nodes[3:]...)
+	gone.Finalize()
+	if listening(gone.ipaddr) {
+		t.Fatalf("%s still listens after Finalize", gone.ipaddr)
+	}
+	//the remaining nodes repair their routing state around the failure
+	time.Sleep(100 * time.Millisecond)
+	converge(t, nodes)
+	checkRing(t, nodes)
+	checkLookups(t, nodes)
+}
+
+func TestSuccessorFailureSingleEntry(t *testing.T) {
+	const bits = 8
+	addrs := testAddrs(19400, 4, bits)
+	opts := append(testOptions(bits), WithSuccessors(1))
+	nodes := []*ChordNode{Create(addrs[0], opts...)}
+	defer func() {
+		for _, node := range nodes {
+			node.Finalize()
+		}
+	}()
+	for _, addr := range addrs[1:] {
+		node, err := Join(addr, []string{addrs[0]}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	converge(t, nodes)
+	checkRing(t, nodes)
+
+	//with a single entry in the successor list, a node whose successor fails
+	//has no other successor to fall back on and rejoins the ring
+	node := nodes[0]
+	var gone *ChordNode
+	for i, other := range nodes {
+		if other.ipaddr == node.Successor().ipaddr {
+			gone = other
+			nodes = append(nodes[:i], nodes[i+1:]...)
+			break
+		}
+	}
+	if gone == nil {
+		t.Fatalf("successor %s of %s is not in the ring", node.Successor(), node.ipaddr)
+	}
+	gone.Finalize()
+	time.Sleep(100 * time.Millisecond)
+	converge(t, nodes)
+	if node.Successor().ipaddr == gone.ipaddr {
+		t.Fatalf("%s kept its failed successor %s", node.ipaddr, gone.ipaddr)
+	}
+	checkRing(t, nodes)
+	checkLookups(t, nodes)
+}
+
+func TestRejoin(t *testing.T) {
+	const bits = 8
+	tests := []struct {
+		name string
+		port int
+		//seed is true if the node's failed successor is not its seed, so
+		//that it rejoins through the seed rather than the peers it
+		//remembers
+		seed bool
+	}{
+		{"through a seed", 19410, true},
+		{"through remembered peers", 19420, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addrs := testAddrs(test.port, 3, bits)
+			opts := append(testOptions(bits), WithSuccessors(1))
+			nodes := []*ChordNode{Create(addrs[0], opts...)}
+			subs := []*Subscription{nil}
+			defer func() {
+				for _, node := range nodes {
+					node.Finalize()
+				}
+			}()
+			for _, addr := range addrs[1:] {
+				sub := NewSubscription(64)
+				node, err := Join(addr, []string{addrs[0]}, append(opts, WithSubscription(sub))...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				nodes, subs = append(nodes, node), append(subs, sub)
+			}
+			converge(t, nodes)
+			checkRing(t, nodes)
+
+			//one of the nodes that joined through the seed succeeds
+			//it, the other one precedes it
+			var node, gone *ChordNode
+			var sub *Subscription
+			for i := 1; i < len(nodes); i++ {
+				if (nodes[i].Successor().ipaddr != addrs[0]) == test.seed {
+					node, sub = nodes[i], subs[i]
+				}
+			}
+			for i, other := range nodes {
+				if other.ipaddr == node.Successor().ipaddr {
+					gone = other
+					nodes = append(nodes[:i], nodes[i+1:]...)
+					break
+				}
+			}
+			want := addrs[0]
+			if !test.seed {
+				want = nodes[0].ipaddr
+				if want == node.ipaddr {
+					want = nodes[1].ipaddr
+				}
+			}
+			gone.Finalize()
+			time.Sleep(100 * time.Millisecond)
+			converge(t, nodes)
+			if node.Isolated() {
+				t.Fatalf("%s is still isolated", node.ipaddr)
+			}
+			checkRing(t, nodes)
+
+			var joined []string
+			for len(sub.C) > 0 {
+				if e := <-sub.C; e.Type == Joined {
+					joined = append(joined, e.Peer.ipaddr)
+				}
+			}
+			if len(joined) != 2 || joined[0] != addrs[0] || joined[1] != want {
+				t.Errorf("%s joined through %v, want [%s %s]", node.ipaddr, joined, addrs[0], want)
+			}
+		})
+	}
+}
+
+func TestLookupSuccessorLocally(t *testing.T) {
+	node := Create("127.0.0.1:19430", testOptions(8)...)
+	defer node.Finalize()
+
+	//the successor accepts connections but never replies, and counts them
+	l, err := net.Listen("tcp", "127.0.0.1:19431")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var conns int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			conn.Close()
+		}
+	}()
+	successor := Finger{ipaddr: l.Addr().String()}
+	successor.id[len(successor.id)-1] = node.id[len(node.id)-1] + 5
+	node.setSuccessor(successor)
+
+	//keys between the node and its successor are answered without asking
+	//any node
+	for i := byte(1); i <= 5; i++ {
+		var key ID
+		key[len(key)-1] = node.id[len(node.id)-1] + i
+		if addr, err := node.Lookup(key); err != nil || addr != successor.ipaddr {
+			t.Errorf("lookup of %x: %s, %v; want %s", key[len(key)-1], addr, err, successor.ipaddr)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 0 {
+		t.Errorf("%d connections made to look up keys held by the successor", n)
+	}
+}
@@ -0,0 +1,348 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"crypto/sha256"
+	"time"
+)
+
+//Config holds the tunable parameters of a ChordNode.
+type Config struct {
+	//Bits is the size m of the identifier space. Identifiers lie in [0, 2^m).
+	Bits int
+
+	//StabilizeInterval, CheckPredInterval and FixInterval are the average
+	//times between rounds of stabilization, predecessor checks and finger
+	//fixing. FixBatch is the number of fingers fixed in each round.
+	StabilizeInterval time.Duration
+	CheckPredInterval time.Duration
+	FixInterval       time.Duration
+	FixBatch          int
+	//PartitionInterval is the average time between probes of remembered
+	//peers for other rings to merge with.
+	PartitionInterval time.Duration
+	//Adaptive makes the stabilization and finger fixing intervals adapt to
+	//churn. They start at StabilizeInterval and FixInterval, drop to
+	//MinInterval whenever a round observes a change or failure and double
+	//after every quiet round, up to MaxInterval.
+	Adaptive    bool
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	//Manual disables the background maintenance loops. The routing state is
+	//then only maintained by calls to Stabilize, CheckPredecessor, FixFingers
+	//and Converge.
+	Manual bool
+	//Jitter is the fraction by which each interval is randomly shortened or
+	//lengthened, so that nodes do not run their maintenance in lockstep.
+	Jitter float64
+	//Timeout bounds the time spent connecting to a peer, sending it a
+	//message and waiting for its reply.
+	Timeout time.Duration
+
+	//PhiThreshold is the suspicion level at which the failure detector
+	//considers a peer that stopped replying to have failed.
+	PhiThreshold float64
+
+	//Successors is the length r of the successor list. The node also keeps a
+	//predecessor list of the same length.
+	Successors int
+
+	//JoinAttempts is the number of times Join tries all of its seeds before
+	//giving up.
+	JoinAttempts int
+	//JoinBackoff is the time Join waits after the first failed attempt. The
+	//wait doubles after every further attempt, up to JoinMaxBackoff.
+	JoinBackoff    time.Duration
+	JoinMaxBackoff time.Duration
+	//JoinInBackground makes Join return after its first failed attempt and
+	//keep retrying in the background until the node has joined.
+	JoinInBackground bool
+
+	//Rejoined is called with the address of the peer used to rejoin the ring
+	//after the node lost all of its successors.
+	Rejoined func(addr string)
+
+	//StateFile is the path of the file in which the node saves its routing
+	//state. If it is empty, the routing state is not saved.
+	StateFile string
+
+	//Subscriptions receive the node's events from the moment it is
+	//created.
+	Subscriptions []*Subscription
+}
+
+//Option configures a ChordNode when it is created or joined.
+type Option func(*Config)
+
+//DefaultConfig returns the configuration used when no options are given.
+func DefaultConfig() Config {
+	return Config{
+		Bits:              sha256.Size * 8,
+		StabilizeInterval: 90 * time.Second,
+		CheckPredInterval: 90 * time.Second,
+		FixInterval:       90 * time.Second,
+		FixBatch:          1,
+		PartitionInterval: 90 * time.Second,
+		Jitter:            1,
+		Timeout:           3 * time.Minute,
+		PhiThreshold:      8,
+		Successors:        16,
+		JoinAttempts:      1,
+		JoinBackoff:       time.Second,
+		JoinMaxBackoff:    time.Minute,
+	}
+}
+
+//WithBits sets the size of the identifier space to m bits. Small values of m
+//(e.g. 8 or 16) are useful for simulations and for verifying a ring
+//exhaustively. Values outside of [1, 256] are ignored.
+func WithBits(m int) Option {
+	return func(c *Config) {
+		if m >= 1 && m <= sha256.Size*8 {
+			c.Bits = m
+		}
+	}
+}
+
+//WithConfig replaces the whole configuration. Options given after it modify
+//the new configuration.
+func WithConfig(cfg Config) Option {
+	return func(c *Config) {
+		*c = cfg
+	}
+}
+
+//WithStabilizeInterval sets the average time between rounds of stabilization.
+func WithStabilizeInterval(d time.Duration) Option {
+	return func(c *Config) {
+		if d > 0 {
+			c.StabilizeInterval = d
+		}
+	}
+}
+
+//WithCheckPredInterval sets the average time between checks of the
+//predecessor.
+func WithCheckPredInterval(d time.Duration) Option {
+	return func(c *Config) {
+		if d > 0 {
+			c.CheckPredInterval = d
+		}
+	}
+}
+
+//WithFixFingers sets the average time between rounds of finger fixing and the
+//number of fingers fixed in each round.
+func WithFixFingers(d time.Duration, batch int) Option {
+	return func(c *Config) {
+		if d > 0 {
+			c.FixInterval = d
+		}
+		if batch >= 1 {
+			c.FixBatch = batch
+		}
+	}
+}
+
+//WithPartitionInterval sets the average time between probes for other rings
+//to merge with.
+func WithPartitionInterval(d time.Duration) Option {
+	return func(c *Config) {
+		if d > 0 {
+			c.PartitionInterval = d
+		}
+	}
+}
+
+//WithAdaptiveMaintenance makes stabilization and finger fixing run as often
+//as every min while successors and fingers are changing or failing, and back
+//off exponentially to once every max while the ring is stable.
+func WithAdaptiveMaintenance(min time.Duration, max time.Duration) Option {
+	return func(c *Config) {
+		if min > 0 && max >= min {
+			c.Adaptive = true
+			c.MinInterval = min
+			c.MaxInterval = max
+		}
+	}
+}
+
+//WithoutMaintenance disables the background maintenance loops, so that tests
+//can drive the ring step by step with Stabilize, CheckPredecessor, FixFingers
+//and Converge.
+func WithoutMaintenance() Option {
+	return func(c *Config) {
+		c.Manual = true
+	}
+}
+
+//WithJitter sets the fraction by which maintenance intervals are randomly
+//shortened or lengthened. A jitter of 0 runs maintenance at exact intervals.
+func WithJitter(j float64) Option {
+	return func(c *Config) {
+		if j >= 0 && j <= 1 {
+			c.Jitter = j
+		}
+	}
+}
+
+//WithTimeout sets the time allowed for connecting to a peer, sending it a
+//message and receiving its reply.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		if d > 0 {
+			c.Timeout = d
+		}
+	}
+}
+
+//WithPhiThreshold sets the suspicion level at which the failure detector
+//considers a peer that stopped replying to have failed. Lower values detect
+//failures sooner but mistake more slow peers for failed ones.
+func WithPhiThreshold(phi float64) Option {
+	return func(c *Config) {
+		if phi > 0 {
+			c.PhiThreshold = phi
+		}
+	}
+}
+
+//WithSuccessors sets the length r of the successor list and of the
+//predecessor list. Values smaller than 1 are ignored.
+func WithSuccessors(r int) Option {
+	return func(c *Config) {
+		if r >= 1 {
+			c.Successors = r
+		}
+	}
+}
+
+//WithJoinRetry makes Join try all of its seeds up to attempts times, waiting
+//backoff after the first failed attempt and doubling the wait after every
+//further attempt, up to max.
+func WithJoinRetry(attempts int, backoff time.Duration, max time.Duration) Option {
+	return func(c *Config) {
+		if attempts >= 1 {
+			c.JoinAttempts = attempts
+		}
+		if backoff > 0 {
+			c.JoinBackoff = backoff
+		}
+		if max > 0 {
+			c.JoinMaxBackoff = max
+		}
+		if c.JoinMaxBackoff < c.JoinBackoff {
+			c.JoinMaxBackoff = c.JoinBackoff
+		}
+	}
+}
+
+//WithBackgroundJoin makes Join return after its first failed attempt and
+//keep retrying in the background until the node has joined the ring.
+func WithBackgroundJoin() Option {
+	return func(c *Config) {
+		c.JoinInBackground = true
+	}
+}
+
+//WithRejoinHandler sets a function to be called whenever the node rejoins the
+//ring after losing all of its successors. It is called with the address of
+//the peer the node rejoined through.
+func WithRejoinHandler(f func(addr string)) Option {
+	return func(c *Config) {
+		c.Rejoined = f
+	}
+}
+
+//WithSubscription delivers the node's events to s, which must have been
+//returned by NewSubscription, from the moment the node is created. Unlike a
+//subscription made with Subscribe once Join returned, it also receives the
+//Joined event of the first join and the events of the routing state Join
+//sets up.
+func WithSubscription(s *Subscription) Option {
+	return func(c *Config) {
+		c.Subscriptions = append(c.Subscriptions, s)
+	}
+}
+
+//WithStateFile makes the node save its predecessor, successor list and finger
+//table to the file at path after every round of maintenance. When the node is
+//restarted with the same file, it checks which of the saved peers are still
+//alive and resumes from them instead of joining the ring from scratch.
+func WithStateFile(path string) Option {
+	return func(c *Config) {
+		c.StateFile = path
+	}
+}
+
+func newConfig(opts []Option) Config {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	//fall back on the defaults for values a Config given to WithConfig
+	//left unset
+	def := DefaultConfig()
+	if cfg.Bits < 1 || cfg.Bits > sha256.Size*8 {
+		cfg.Bits = def.Bits
+	}
+	if cfg.StabilizeInterval <= 0 {
+		cfg.StabilizeInterval = def.StabilizeInterval
+	}
+	if cfg.CheckPredInterval <= 0 {
+		cfg.CheckPredInterval = def.CheckPredInterval
+	}
+	if cfg.FixInterval <= 0 {
+		cfg.FixInterval = def.FixInterval
+	}
+	if cfg.FixBatch < 1 {
+		cfg.FixBatch = def.FixBatch
+	}
+	if cfg.PartitionInterval <= 0 {
+		cfg.PartitionInterval = def.PartitionInterval
+	}
+	if cfg.Adaptive && (cfg.MinInterval <= 0 || cfg.MaxInterval < cfg.MinInterval) {
+		cfg.Adaptive = false
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = def.Timeout
+	}
+	if cfg.PhiThreshold <= 0 {
+		cfg.PhiThreshold = def.PhiThreshold
+	}
+	if cfg.Successors < 1 {
+		cfg.Successors = def.Successors
+	}
+	if cfg.JoinAttempts < 1 {
+		cfg.JoinAttempts = def.JoinAttempts
+	}
+	if cfg.JoinBackoff <= 0 {
+		cfg.JoinBackoff = def.JoinBackoff
+	}
+	if cfg.JoinMaxBackoff < cfg.JoinBackoff {
+		cfg.JoinMaxBackoff = cfg.JoinBackoff
+	}
+	return cfg
+}
@@ -0,0 +1,99 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"context"
+)
+
+//Stabilize runs one round of stabilization: it checks that the successor is
+//alive, refreshes the successor list and tells the successor about the node.
+func (node *ChordNode) Stabilize() {
+	node.stabilize()
+}
+
+//CheckPredecessor checks that the predecessor is alive and refreshes the
+//predecessor list.
+func (node *ChordNode) CheckPredecessor() {
+	node.checkPred()
+}
+
+//FixFingers refreshes every entry of the finger table once.
+func (node *ChordNode) FixFingers() {
+	for i := 2; i <= node.bits; i++ {
+		node.fix(i)
+	}
+}
+
+//Converge runs rounds of stabilization, predecessor checks and finger fixing
+//until a round leaves the node's routing state unchanged or ctx is done.
+//Other nodes may still change the node's state afterwards; use ConvergeRing
+//to drive a whole ring to a fixed point.
+func (node *ChordNode) Converge(ctx context.Context) error {
+	for {
+		if !node.round() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+//ConvergeRing runs rounds of maintenance on every one of nodes until a full
+//pass over them changes no node's routing state or ctx is done. A round can
+//change the state of other nodes, such as the predecessor of the node's
+//successor, so the state of every node is compared across the whole pass.
+func ConvergeRing(ctx context.Context, nodes ...*ChordNode) error {
+	for {
+		before := make([]Snapshot, len(nodes))
+		for i, node := range nodes {
+			before[i] = node.Snapshot()
+		}
+		for _, node := range nodes {
+			node.round()
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		changed := false
+		for i, node := range nodes {
+			if !sameSnapshot(before[i], node.Snapshot()) {
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+	}
+}
+
+//round runs one round of every maintenance operation and returns true if the
+//node's routing state changed
+func (node *ChordNode) round() bool {
+	before := node.Snapshot()
+	node.Stabilize()
+	node.CheckPredecessor()
+	node.FixFingers()
+	return !sameSnapshot(before, node.Snapshot())
+}
@@ -0,0 +1,242 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+//testOptions configures the nodes of the test rings: a small identifier
+//space, and maintenance driven by the tests
+func testOptions(bits int) []Option {
+	return []Option{WithBits(bits), WithSuccessors(3), WithoutMaintenance(), WithTimeout(time.Second)}
+}
+
+//testAddrs returns n addresses on consecutive ports from port whose
+//identifiers differ in an identifier space of the given size
+func testAddrs(port int, n int, bits int) []string {
+	var addrs []string
+	seen := make(map[ID]bool)
+	for len(addrs) < n {
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		port++
+		id := reduce(sha256.Sum256([]byte(addr)), bits)
+		if !seen[id] {
+			seen[id] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+//converge drives nodes to a fixed point
+func converge(t *testing.T, nodes []*ChordNode) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := ConvergeRing(ctx, nodes...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//owner returns the first of the nodes sorted by identifier that succeeds id
+func owner(sorted []*ChordNode, id ID) *ChordNode {
+	for _, node := range sorted {
+		if bytes.Compare(node.id[:], id[:]) >= 0 {
+			return node
+		}
+	}
+	return sorted[0]
+}
+
+//checkRing checks the routing state of every one of nodes against the ring
+//they form
+func checkRing(t *testing.T, nodes []*ChordNode) {
+	t.Helper()
+	sorted := append([]*ChordNode(nil), nodes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].id[:], sorted[j].id[:]) < 0
+	})
+	n := len(sorted)
+	for i, node := range sorted {
+		if n == 1 {
+			if !node.Successor().zero() || !node.Predecessor().zero() {
+				t.Errorf("%s is alone but has successor %s and predecessor %s", node.ipaddr, node.Successor(), node.Predecessor())
+			}
+			continue
+		}
+		if succ := sorted[(i+1)%n]; node.Successor().ipaddr != succ.ipaddr {
+			t.Errorf("successor of %s is %s, want %s", node.ipaddr, node.Successor(), succ.ipaddr)
+		}
+		if pred := sorted[(i+n-1)%n]; node.Predecessor().ipaddr != pred.ipaddr {
+			t.Errorf("predecessor of %s is %s, want %s", node.ipaddr, node.Predecessor(), pred.ipaddr)
+		}
+		successors := node.SuccessorList()
+		for j := 0; j < len(successors) && j < n-1; j++ {
+			if want := sorted[(i+1+j)%n]; successors[j].ipaddr != want.ipaddr {
+				t.Errorf("successor %d of %s is %s, want %s", j, node.ipaddr, successors[j], want.ipaddr)
+			}
+		}
+		fingers := node.Fingers()
+		if len(fingers) != node.bits+1 {
+			t.Fatalf("%s has %d fingers, want %d", node.ipaddr, len(fingers), node.bits+1)
+		}
+		//fingers whose target the node succeeds itself are left empty
+		for k := 1; k <= node.bits; k++ {
+			var start ID
+			copy(start[:], target(node.id, k, node.bits))
+			want := owner(sorted, start).ipaddr
+			if want == node.ipaddr && k > 1 {
+				want = ""
+			}
+			if fingers[k].ipaddr != want {
+				t.Errorf("finger %d of %s is %s, want %s", k, node.ipaddr, fingers[k], want)
+			}
+		}
+	}
+}
+
+//checkLookups looks up every identifier of the space from every one of nodes
+func checkLookups(t *testing.T, nodes []*ChordNode) {
+	t.Helper()
+	sorted := append([]*ChordNode(nil), nodes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].id[:], sorted[j].id[:]) < 0
+	})
+	for k := 0; k < 1<<uint(nodes[0].bits); k++ {
+		var key ID
+		key[len(key)-2], key[len(key)-1] = byte(k>>8), byte(k)
+		want := owner(sorted, key).ipaddr
+		for _, node := range nodes {
+			if addr, err := node.Lookup(key); err != nil || addr != want {
+				t.Fatalf("%s looked up %x: %s, %v; want %s", node.ipaddr, key[len(key)-2:], addr, err, want)
+			}
+		}
+	}
+}
+
+func TestConvergeJoins(t *testing.T) {
+	const bits = 8
+	addrs := testAddrs(19200, 6, bits)
+	var nodes []*ChordNode
+	defer func() {
+		for _, node := range nodes {
+			node.Finalize()
+		}
+	}()
+	for i, addr := range addrs {
+		if i == 0 {
+			nodes = append(nodes, Create(addr, testOptions(bits)...))
+		} else {
+			node, err := Join(addr, []string{addrs[0]}, testOptions(bits)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes = append(nodes, node)
+		}
+		converge(t, nodes)
+		checkRing(t, nodes)
+		checkLookups(t, nodes)
+		//a ring at its fixed point does not change with another round
+		for _, node := range nodes {
+			if node.round() {
+				t.Errorf("%s changed after the ring converged with %d nodes", node.ipaddr, len(nodes))
+			}
+		}
+	}
+}
+
+func TestConvergeLargeIdentifiers(t *testing.T) {
+	//identifiers that do not fit in a byte are encoded on two
+	const bits = 12
+	addrs := testAddrs(19210, 4, bits)
+	nodes := []*ChordNode{Create(addrs[0], testOptions(bits)...)}
+	defer func() {
+		for _, node := range nodes {
+			node.Finalize()
+		}
+	}()
+	for _, addr := range addrs[1:] {
+		node, err := Join(addr, []string{addrs[0]}, testOptions(bits)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	converge(t, nodes)
+	checkRing(t, nodes)
+	checkLookups(t, nodes)
+}
+
+func TestSmallIdentifierSpace(t *testing.T) {
+	var me ID
+	me[len(me)-1] = 250
+	tests := []struct {
+		which int
+		want  byte
+	}{
+		{1, 251},
+		{3, 254},
+		{4, 2},
+		{8, 122},
+	}
+	for _, test := range tests {
+		got := target(me, test.which, 8)
+		var want ID
+		want[len(want)-1] = test.want
+		if !bytes.Equal(got, want[:]) {
+			t.Errorf("target %d of 250 is %x, want %d", test.which, got[len(got)-1], test.want)
+		}
+	}
+
+	digest := sha256.Sum256([]byte("key"))
+	reduced := reduce(digest, 8)
+	for _, b := range reduced[:len(reduced)-1] {
+		if b != 0 {
+			t.Fatalf("%x does not fit in 8 bits", reduced)
+		}
+	}
+	if reduced[len(reduced)-1] != digest[len(digest)-1] {
+		t.Errorf("reduce kept %x of %x", reduced[len(reduced)-1], digest[len(digest)-1])
+	}
+	if reduce(digest, sha256.Size*8) != digest {
+		t.Errorf("reduce changed a full identifier")
+	}
+
+	for _, test := range []struct{ bits, bytes int }{{1, 1}, {8, 1}, {9, 2}, {16, 2}, {256, 32}} {
+		if n := idLen(test.bits); n != test.bytes {
+			t.Errorf("identifiers of %d bits encoded on %d bytes, want %d", test.bits, n, test.bytes)
+		}
+	}
+	for _, m := range []int{0, -1, sha256.Size*8 + 1} {
+		if cfg := newConfig([]Option{WithBits(m)}); cfg.Bits != sha256.Size*8 {
+			t.Errorf("WithBits(%d) set %d bits", m, cfg.Bits)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+//detectorWindow is the number of intervals between replies remembered for
+//each peer
+const detectorWindow = 100
+
+//detectorMinSamples is the number of intervals needed before the detector
+//trusts its estimate. Until then a peer is suspected as soon as a message to
+//it fails.
+const detectorMinSamples = 3
+
+//detector is a phi accrual failure detector (Hayashibara et al., 2004). It
+//records when each peer last replied to the node and the intervals between
+//its replies. When a message to a peer fails, the suspicion level phi tells
+//how unlikely it is, given the peer's history, that it has stayed silent for
+//so long and is still alive.
+type detector struct {
+	lock      sync.Mutex
+	peers     map[string]*history
+	threshold float64
+}
+
+//history is the reply history of a single peer
+type history struct {
+	last      time.Time
+	intervals []float64
+	failed    bool
+}
+
+func newDetector(threshold float64) *detector {
+	d := new(detector)
+	d.peers = make(map[string]*history)
+	d.threshold = threshold
+	return d
+}
+
+//reply records that the peer at addr replied to a message
+func (d *detector) reply(addr string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	h, ok := d.peers[addr]
+	if !ok {
+		h = new(history)
+		d.peers[addr] = h
+	} else {
+		h.intervals = append(h.intervals, float64(now.Sub(h.last)))
+		if len(h.intervals) > detectorWindow {
+			h.intervals = h.intervals[1:]
+		}
+	}
+	h.last = now
+	h.failed = false
+}
+
+//failure records that a message to the peer at addr failed
+func (d *detector) failure(addr string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	h, ok := d.peers[addr]
+	if !ok {
+		h = new(history)
+		d.peers[addr] = h
+	}
+	h.failed = true
+}
+
+//retain forgets the history of every peer that is not in keep
+func (d *detector) retain(keep map[string]bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for addr := range d.peers {
+		if !keep[addr] {
+			delete(d.peers, addr)
+		}
+	}
+}
+
+//phi returns the suspicion level of the peer at addr. It is 0 for peers that
+//have not failed and infinite for failed peers without enough history.
+func (d *detector) phi(addr string) float64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	h, ok := d.peers[addr]
+	if !ok || !h.failed {
+		return 0
+	}
+	if len(h.intervals) < detectorMinSamples || h.last.IsZero() {
+		return math.Inf(1)
+	}
+
+	var mean, variance float64
+	for _, x := range h.intervals {
+		mean += x
+	}
+	mean /= float64(len(h.intervals))
+	for _, x := range h.intervals {
+		variance += (x - mean) * (x - mean)
+	}
+	variance /= float64(len(h.intervals))
+	//keep the deviation from collapsing for peers that reply like clockwork
+	std := math.Max(math.Sqrt(variance), mean/10)
+
+	//logistic approximation of the normal distribution's tail
+	t := float64(time.Since(h.last))
+	y := (t - mean) / std
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if t > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+//Phi returns the failure detector's suspicion level for the peer at addr. A
+//peer whose last message went through has a suspicion level of 0.
+func (node *ChordNode) Phi(addr string) float64 {
+	return node.detector.phi(addr)
+}
+
+//pruneDetector forgets the reply histories of the peers that are no longer in
+//the node's routing state, so that the failure detector does not keep every
+//peer the node ever sent a message to
+func (node *ChordNode) pruneDetector() {
+	s := node.Snapshot()
+	keep := make(map[string]bool)
+	for _, list := range [][]Finger{s.Predecessors, s.Successors, s.Fingers} {
+		for _, f := range list {
+			if !f.zero() {
+				keep[f.ipaddr] = true
+			}
+		}
+	}
+	node.detector.retain(keep)
+}
+
+//Suspect returns true if the node believes the peer at addr has failed: the
+//last message to the peer failed and the peer has been silent for longer than
+//its reply history can explain.
+func (node *ChordNode) Suspect(addr string) bool {
+	return node.detector.phi(addr) >= node.detector.threshold
+}
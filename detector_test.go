@@ -0,0 +1,68 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"testing"
+)
+
+//tracked returns true if the failure detector of node holds a history for
+//the peer at addr
+func tracked(node *ChordNode, addr string) bool {
+	node.detector.lock.Lock()
+	defer node.detector.lock.Unlock()
+	_, ok := node.detector.peers[addr]
+	return ok
+}
+
+func TestDetectorForgetsPeers(t *testing.T) {
+	addrs := testAddrs(19250, 3, 8)
+	nodes := []*ChordNode{Create(addrs[0], testOptions(8)...)}
+	for _, addr := range addrs[1:] {
+		node, err := Join(addr, []string{addrs[0]}, testOptions(8)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	defer func() {
+		for _, node := range nodes {
+			node.Finalize()
+		}
+	}()
+	converge(t, nodes)
+
+	//a peer outside the routing state is forgotten by the next round
+	stranger := "127.0.0.1:19259"
+	nodes[0].send(pingMsg(), stranger)
+	if !tracked(nodes[0], stranger) {
+		t.Fatalf("failed message to %s not recorded", stranger)
+	}
+	nodes[0].Stabilize()
+	if tracked(nodes[0], stranger) {
+		t.Errorf("%s still tracked after it left the routing state", stranger)
+	}
+	if succ := nodes[0].Successor().ipaddr; !tracked(nodes[0], succ) {
+		t.Errorf("successor %s not tracked", succ)
+	}
+}
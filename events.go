@@ -0,0 +1,181 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//EventType identifies the kind of change an Event reports.
+type EventType int
+
+const (
+	//PredecessorChanged is sent when the node adopts a new predecessor.
+	PredecessorChanged EventType = iota
+	//SuccessorChanged is sent when the node adopts a new successor.
+	SuccessorChanged
+	//SuccessorListChanged is sent when any entry of the successor list
+	//changes.
+	SuccessorListChanged
+	//FingerUpdated is sent when an entry of the finger table changes.
+	FingerUpdated
+	//PeerFailed is sent when the node gives up on a peer it was routing
+	//through.
+	PeerFailed
+	//Joined is sent when the node joins or rejoins a ring.
+	Joined
+	//Left is sent when the node leaves the ring.
+	Left
+)
+
+func (t EventType) String() string {
+	switch t {
+	case PredecessorChanged:
+		return "PredecessorChanged"
+	case SuccessorChanged:
+		return "SuccessorChanged"
+	case SuccessorListChanged:
+		return "SuccessorListChanged"
+	case FingerUpdated:
+		return "FingerUpdated"
+	case PeerFailed:
+		return "PeerFailed"
+	case Joined:
+		return "Joined"
+	case Left:
+		return "Left"
+	}
+	return "Unknown"
+}
+
+//Event describes a change in a node's routing state.
+type Event struct {
+	Type EventType
+	//Peer is the new predecessor, successor or finger, the peer that
+	//failed, or the peer the node joined through.
+	Peer Finger
+	//Old is the previous predecessor, successor or finger.
+	Old Finger
+	//Index is the index of the finger that was updated.
+	Index int
+	//List is the new successor list.
+	List []Finger
+}
+
+//Subscription delivers the events of a node over the channel C. Events are
+//dropped rather than delaying the node if the channel's buffer is full.
+type Subscription struct {
+	C <-chan Event
+
+	c       chan Event
+	node    *ChordNode
+	dropped uint64
+	closed  bool
+}
+
+//subscribers holds the subscriptions of a node
+type subscribers struct {
+	sync.Mutex
+	subs map[*Subscription]bool
+}
+
+//Subscribe returns a subscription to the node's events, buffering up to
+//buffer events that have not been received yet.
+func (node *ChordNode) Subscribe(buffer int) *Subscription {
+	s := NewSubscription(buffer)
+	node.attach(s)
+	return s
+}
+
+//NewSubscription returns a subscription that buffers up to buffer events and
+//is not attached to a node yet. Pass it to WithSubscription to receive the
+//events of a node from the moment the node is created.
+func NewSubscription(buffer int) *Subscription {
+	if buffer < 0 {
+		buffer = 0
+	}
+	s := new(Subscription)
+	s.c = make(chan Event, buffer)
+	s.C = s.c
+	return s
+}
+
+//attach starts delivering the node's events to s
+func (node *ChordNode) attach(s *Subscription) {
+	node.subscribers.Lock()
+	defer node.subscribers.Unlock()
+	if s.closed || s.node != nil {
+		return
+	}
+	s.node = node
+	node.subscribers.subs[s] = true
+}
+
+//Unsubscribe stops the delivery of events and closes C.
+func (s *Subscription) Unsubscribe() {
+	if s.node == nil {
+		if !s.closed {
+			s.closed = true
+			close(s.c)
+		}
+		return
+	}
+	s.node.subscribers.Lock()
+	defer s.node.subscribers.Unlock()
+	if !s.closed {
+		s.closed = true
+		delete(s.node.subscribers.subs, s)
+		close(s.c)
+	}
+}
+
+//Dropped returns the number of events that were dropped because the
+//subscription's buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+//emit delivers an event to every subscription without blocking
+func (node *ChordNode) emit(e Event) {
+	node.subscribers.Lock()
+	defer node.subscribers.Unlock()
+	for s := range node.subscribers.subs {
+		select {
+		case s.c <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+//closeSubscriptions closes every subscription of the node
+func (node *ChordNode) closeSubscriptions() {
+	node.subscribers.Lock()
+	defer node.subscribers.Unlock()
+	for s := range node.subscribers.subs {
+		s.closed = true
+		close(s.c)
+	}
+	node.subscribers.subs = make(map[*Subscription]bool)
+}
@@ -0,0 +1,98 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSubscriptionFromCreation(t *testing.T) {
+	seed := "127.0.0.1:19240"
+	first := Create(seed, testOptions(8)...)
+	defer first.Finalize()
+
+	sub := NewSubscription(16)
+	node, err := Join("127.0.0.1:19241", []string{seed}, append(testOptions(8), WithSubscription(sub))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Finalize()
+
+	var types []EventType
+	joined := false
+	for len(sub.C) > 0 {
+		e := <-sub.C
+		types = append(types, e.Type)
+		if e.Type == Joined {
+			joined = true
+			if e.Peer.ipaddr != seed {
+				t.Errorf("joined through %s, want %s", e.Peer, seed)
+			}
+		}
+	}
+	if !joined {
+		t.Errorf("events before Join returned: %v, want a Joined event", types)
+	}
+}
+
+func TestEventOrder(t *testing.T) {
+	node := Create("127.0.0.1:19242", testOptions(8)...)
+	defer node.Finalize()
+	sub := node.Subscribe(10000)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				var f Finger
+				f.id[len(f.id)-1] = byte(i*100 + j)
+				f.ipaddr = fmt.Sprintf("127.0.0.1:%d", 20000+i*100+j)
+				node.setSuccessor(f)
+			}
+		}(i)
+	}
+	wg.Wait()
+	sub.Unsubscribe()
+
+	//every change starts from the state the previous one left
+	var last Finger
+	for e := range sub.C {
+		if e.Type != SuccessorChanged {
+			continue
+		}
+		if e.Old != last {
+			t.Fatalf("successor changed from %s, but the previous event set it to %s", e.Old, last)
+		}
+		last = e.Peer
+	}
+	if sub.Dropped() != 0 {
+		t.Fatalf("%d events dropped", sub.Dropped())
+	}
+	if last != node.Successor() {
+		t.Errorf("last event set the successor to %s, but it is %s", last, node.Successor())
+	}
+}
@@ -0,0 +1,377 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/cbocovic/chord"
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/cbocovic/chord/storage"
+	"github.com/golang/protobuf/proto"
+	"math/big"
+	"sync"
+	"time"
+)
+
+//Anti-entropy compares the keys a node owns with the copies held by its
+//replicas using Merkle trees over the node's range of identifiers. The range
+//is the root of the tree, and every range is split into merkleFanout equal
+//parts. The node asks a replica for the hashes of a whole level of the tree
+//at once and only descends into the ranges whose hashes differ. Once a range
+//holds few keys, the node and the replica compare the digests of the
+//individual keys and exchange the ones that differ.
+const (
+	merkleFanout = 16
+	merkleLeaf   = 32
+	//merkleBatch bounds the number of ranges whose hashes are requested in
+	//a single message, which keeps the reply to a few KiB
+	merkleBatch = 256
+)
+
+//limiter caps the bandwidth used by anti-entropy
+type limiter struct {
+	lock sync.Mutex
+	rate int
+	next time.Time
+}
+
+//wait blocks until n more bytes may be sent without exceeding the rate
+func (l *limiter) wait(n int) {
+	if l.rate <= 0 {
+		return
+	}
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+	l.lock.Unlock()
+	time.Sleep(delay)
+}
+
+//antiEntropy synchronizes the node's keys with its replicas every interval
+//until done is closed
+func (kv *KV) antiEntropy(done chan struct{}) {
+	ticker := time.NewTicker(kv.aeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			kv.Synchronize()
+		}
+	}
+}
+
+//Synchronize runs one round of anti-entropy: it compares the keys the node is
+//responsible for with the copies held by each of its replicas and repairs the
+//differences: records that differ are merged, so that the node and the
+//replica both end up with every write either of them has seen. It returns the
+//first error encountered.
+func (kv *KV) Synchronize() error {
+	var first error
+	r, ok := kv.node.OwnedRange()
+	if !ok {
+		return nil
+	}
+	for _, addr := range kv.Replicas() {
+		if err := kv.synchronize(addr, r); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+//synchronize repairs the differences between the keys in r held by the node
+//and by the replica at addr
+func (kv *KV) synchronize(addr string, r chord.Range) error {
+	level := []chord.Range{r}
+	for len(level) > 0 {
+		var next []chord.Range
+		for len(level) > 0 {
+			batch := level
+			if len(batch) > merkleBatch {
+				batch = batch[:merkleBatch]
+			}
+			level = level[len(batch):]
+			parts, err := kv.compare(addr, batch)
+			if err != nil {
+				return err
+			}
+			next = append(next, parts...)
+		}
+		level = next
+	}
+	return nil
+}
+
+//compare compares the hashes of the ranges in level with those of the replica
+//at addr. It repairs the differing ranges that hold few keys and returns the
+//parts of the other differing ranges.
+func (kv *KV) compare(addr string, level []chord.Range) ([]chord.Range, error) {
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Hashes.Enum()
+	for _, r := range level {
+		msg.Ranges = append(msg.Ranges, rangeMsg(r))
+	}
+	reply, err := kv.exchange(msg, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.GetHashes()) != len(level) || len(reply.GetCounts()) != len(level) {
+		return nil, &chord.PeerError{Address: addr, Err: errMalformed}
+	}
+
+	var next []chord.Range
+	for i, r := range level {
+		sum, count, err := kv.hash(r)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(sum, reply.GetHashes()[i]) {
+			continue
+		}
+		parts := kv.split(r)
+		if count+int(reply.GetCounts()[i]) <= merkleLeaf || parts == nil {
+			if err := kv.repair(addr, r); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		next = append(next, parts...)
+	}
+	return next, nil
+}
+
+//repair compares the digests of the records of the keys in r held by the node
+//and by the replica at addr. The records that differ are merged on both sides.
+func (kv *KV) repair(addr string, r chord.Range) error {
+	theirs, err := kv.theirDigests(addr, r)
+	if err != nil {
+		return err
+	}
+
+	//copy the records the replica is missing or holds a different one of
+	push := new(kvMsgs.KVMessage)
+	push.Cmd = kvMsgs.KVMessage_Transfer.Enum()
+	push.Replica = proto.Bool(true)
+	var fetch []string
+	err = kv.engine.Range(r, func(e storage.Entry) bool {
+		digest, ok := theirs[e.Key]
+		delete(theirs, e.Key)
+		if ok && bytes.Equal(digest, valueDigest(e.Value)) {
+			return true
+		}
+		push.Items = append(push.Items, item(e))
+		if ok {
+			fetch = append(fetch, e.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for len(push.Items) > 0 {
+		batch := proto.Clone(push).(*kvMsgs.KVMessage)
+		n, size := 0, 0
+		for n < len(batch.Items) && n < transferBatch && size < transferBytes {
+			size += len(batch.Items[n].GetValue())
+			n++
+		}
+		batch.Items = batch.Items[:n]
+		push.Items = push.Items[n:]
+		if _, err := kv.exchange(batch, addr); err != nil {
+			return err
+		}
+	}
+
+	//fetch the records the node is missing or holds a different one of
+	for key := range theirs {
+		fetch = append(fetch, key)
+	}
+	for _, key := range fetch {
+		get := new(kvMsgs.KVMessage)
+		get.Cmd = kvMsgs.KVMessage_Get.Enum()
+		get.Key = proto.String(key)
+		reply, err := kv.exchange(get, addr)
+		if err != nil {
+			return err
+		}
+		if !reply.GetFound() {
+			continue
+		}
+		rec, err := replyRecord(reply)
+		if err != nil {
+			return &chord.PeerError{Address: addr, Err: err}
+		}
+		if _, err := kv.store(key, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//theirDigests returns the digests of the records of the keys in r held by the
+//replica at addr, which sends them in as many replies as needed
+func (kv *KV) theirDigests(addr string, r chord.Range) (map[string][]byte, error) {
+	theirs := make(map[string][]byte)
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Digests.Enum()
+	msg.Ranges = []*kvMsgs.Range{rangeMsg(r)}
+	for {
+		reply, err := kv.exchange(msg, addr)
+		if err != nil {
+			return nil, err
+		}
+		items := reply.GetItems()
+		for _, item := range items {
+			theirs[item.GetKey()] = item.GetValue()
+		}
+		if !reply.GetMore() {
+			return theirs, nil
+		}
+		if len(items) == 0 {
+			return nil, &chord.PeerError{Address: addr, Err: errMalformed}
+		}
+		msg.Key = proto.String(items[len(items)-1].GetKey())
+	}
+}
+
+//exchange sends an anti-entropy message to addr, keeping within the
+//bandwidth cap
+func (kv *KV) exchange(msg *kvMsgs.KVMessage, addr string) (*kvMsgs.KVMessage, error) {
+	kv.limiter.wait(proto.Size(msg))
+	reply, err := kv.send(msg, addr)
+	if err != nil {
+		return nil, err
+	}
+	kv.limiter.wait(proto.Size(reply))
+	return reply, nil
+}
+
+//hash returns the hash of the keys in r and their number
+func (kv *KV) hash(r chord.Range) ([]byte, int, error) {
+	h := sha256.New()
+	count := 0
+	err := kv.engine.Range(r, func(e storage.Entry) bool {
+		h.Write([]byte(e.Key))
+		h.Write(valueDigest(e.Value))
+		count++
+		return true
+	})
+	return h.Sum(nil), count, err
+}
+
+//digests adds the digest of the record of every key in r to reply, starting
+//after the key after if it is not nil. Once the digests added reach
+//transferBytes, the rest are left for another request and reply.More is set.
+func (kv *KV) digests(r chord.Range, after *string, reply *kvMsgs.KVMessage) error {
+	var last storage.Entry
+	if after != nil {
+		last = kv.entry(*after, nil)
+	}
+	size := 0
+	return kv.engine.Range(r, func(e storage.Entry) bool {
+		if after != nil && precedes(r, e, last) {
+			return true
+		}
+		if size >= transferBytes {
+			reply.More = proto.Bool(true)
+			return false
+		}
+		item := new(kvMsgs.Item)
+		item.Key = proto.String(e.Key)
+		item.Value = valueDigest(e.Value)
+		reply.Items = append(reply.Items, item)
+		size += len(e.Key) + sha256.Size
+		return true
+	})
+}
+
+//valueDigest returns the digest anti-entropy compares values by
+func valueDigest(value []byte) []byte {
+	sum := sha256.Sum256(value)
+	return sum[:]
+}
+
+//split divides r into merkleFanout ranges of equal size, or returns nil if r
+//is too small to be split
+func (kv *KV) split(r chord.Range) []chord.Range {
+	modulus := new(big.Int).Lsh(big.NewInt(1), uint(kv.node.Bits()))
+	start := new(big.Int).SetBytes(r.Start[:])
+	width := new(big.Int).SetBytes(r.End[:])
+	width.Sub(width, start)
+	width.Mod(width, modulus)
+	if width.Sign() == 0 {
+		//the range covers the whole circle
+		width.Set(modulus)
+	}
+	if width.Cmp(big.NewInt(merkleFanout)) < 0 {
+		return nil
+	}
+
+	parts := make([]chord.Range, merkleFanout)
+	prev := r.Start
+	for i := range parts {
+		var end chord.ID
+		if i == merkleFanout-1 {
+			end = r.End
+		} else {
+			offset := new(big.Int).Mul(width, big.NewInt(int64(i+1)))
+			offset.Div(offset, big.NewInt(merkleFanout))
+			offset.Add(offset, start)
+			offset.Mod(offset, modulus)
+			offset.FillBytes(end[:])
+		}
+		parts[i] = chord.Range{Start: prev, End: end}
+		prev = end
+	}
+	return parts
+}
+
+//rangeMsg encodes r for a message
+func rangeMsg(r chord.Range) *kvMsgs.Range {
+	m := new(kvMsgs.Range)
+	m.Start = append([]byte(nil), r.Start[:]...)
+	m.End = append([]byte(nil), r.End[:]...)
+	return m
+}
+
+//parseRange decodes a range received in a message
+func parseRange(m *kvMsgs.Range) chord.Range {
+	return chord.Range{Start: parseID(m.GetStart()), End: parseID(m.GetEnd())}
+}
+
+//parseID decodes an identifier received in a message
+func parseID(b []byte) chord.ID {
+	var id chord.ID
+	if len(b) > len(id) {
+		b = b[len(b)-len(id):]
+	}
+	copy(id[len(id)-len(b):], b)
+	return id
+}
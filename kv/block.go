@@ -0,0 +1,170 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/cbocovic/chord"
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/golang/protobuf/proto"
+	"strings"
+)
+
+//Blocks are immutable values stored under the SHA-256 hash of their content.
+//A block is kept under the key made of blockPrefix and the hex encoding of its
+//hash, which the DHT maps to the hash itself rather than to the hash of the
+//key, so that the block is stored on the node responsible for its hash. Nodes
+//refuse to store a block under any other hash, and readers check every block
+//they fetch, so a corrupted or forged block is never returned.
+const blockPrefix = "block/"
+
+//ErrCorrupt is returned when a block does not match the hash it is stored
+//under.
+var ErrCorrupt = errors.New("block does not match its hash")
+
+//blockKey returns the key the block with identifier id is stored under
+func blockKey(id chord.ID) string {
+	return blockPrefix + hex.EncodeToString(id[:])
+}
+
+//blockID returns the identifier of the block key is the key of, and false if
+//key is not the key of a block
+func blockID(key string) (chord.ID, bool) {
+	var id chord.ID
+	if !strings.HasPrefix(key, blockPrefix) {
+		return id, false
+	}
+	b, err := hex.DecodeString(key[len(blockPrefix):])
+	if err != nil || len(b) != len(id) {
+		return id, false
+	}
+	copy(id[:], b)
+	return id, true
+}
+
+//valid returns true if value may be stored under key: blocks must match the
+//hash they are stored under
+func valid(key string, value []byte) bool {
+	id, ok := blockID(key)
+	return !ok || sha256.Sum256(value) == [sha256.Size]byte(id)
+}
+
+//verified returns rec without the siblings whose values may not be stored
+//under key
+func (rec record) verified(key string) record {
+	if _, ok := blockID(key); !ok {
+		return rec
+	}
+	var v record
+	for _, s := range rec.siblings {
+		if s.deleted || valid(key, s.value) {
+			v.siblings = append(v.siblings, s)
+		}
+	}
+	return v
+}
+
+//PutBlock stores data as a block and returns its identifier, the SHA-256 hash
+//of data.
+func (kv *KV) PutBlock(data []byte) (chord.ID, error) {
+	id := chord.ID(sha256.Sum256(data))
+	return id, kv.Put(blockKey(id), data)
+}
+
+//GetBlock returns the block with identifier id. The block is fetched from the
+//node responsible for id and checked against id. If that node does not hold a
+//valid copy, the block is fetched from the node's replicas in turn, and the
+//nodes that returned a corrupted copy or none are repaired with the valid one.
+//If no node holds a valid copy, the error is ErrCorrupt if one of them held a
+//corrupted copy, and ErrNotFound if any of them answered. The error of a node
+//is returned only if none of them could be reached.
+func (kv *KV) GetBlock(id chord.ID) ([]byte, error) {
+	key := blockKey(id)
+	addrs, err := kv.node.LookupSuccessors(id, kv.replicas+1)
+	if err != nil {
+		return nil, err
+	}
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Get.Enum()
+	msg.Key = proto.String(key)
+
+	var stale []string
+	var unreachable error
+	answered, corrupt := false, false
+	for _, addr := range addrs {
+		reply, err := kv.sendTo(msg, addr)
+		if err != nil {
+			if unreachable == nil {
+				unreachable = err
+			}
+			continue
+		}
+		var rec record
+		if reply.GetFound() {
+			if rec, err = replyRecord(reply); err != nil {
+				if unreachable == nil {
+					unreachable = &chord.PeerError{Address: addr, Err: err}
+				}
+				continue
+			}
+		}
+		answered = true
+		live := rec.live()
+		for _, s := range live {
+			if valid(key, s.value) {
+				if len(stale) > 0 {
+					go kv.repairBlock(key, rec.verified(key), stale)
+				}
+				return s.value, nil
+			}
+		}
+		if len(live) > 0 {
+			corrupt = true
+		}
+		stale = append(stale, addr)
+	}
+	switch {
+	case corrupt:
+		return nil, ErrCorrupt
+	case answered:
+		//the nodes that could not be reached are not taken to hold the
+		//block when every node that answered lacks it
+		return nil, ErrNotFound
+	}
+	return nil, unreachable
+}
+
+//repairBlock sends the valid record of a block to the nodes at addrs that
+//returned a corrupted copy of it or none
+func (kv *KV) repairBlock(key string, rec record, addrs []string) {
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Put.Enum()
+	msg.Key = proto.String(key)
+	msg.Record = rec.encode()
+	msg.Replica = proto.Bool(true)
+	for _, addr := range addrs {
+		kv.sendTo(msg, addr)
+	}
+}
@@ -0,0 +1,103 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"crypto/sha256"
+	"github.com/cbocovic/chord"
+	"testing"
+	"time"
+)
+
+//corrupt replaces the copy of the block id held by kv with a forged one
+func corrupt(t *testing.T, kv *KV, id chord.ID) {
+	t.Helper()
+	rec := record{[]sibling{kv.sibling([]byte("forged"), false, nil)}}
+	if err := kv.engine.Put(kv.entry(blockKey(id), rec.encode())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetBlockMissing(t *testing.T) {
+	nodes, stores := newRing(t, 19180, 3, WithReplicas(2))
+	id := chord.ID(sha256.Sum256([]byte("missing")))
+	addrs, err := nodes[0].LookupSuccessors(id, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the owner looks the block up itself, so that the lookup does not
+	//depend on the holder that goes down
+	owner := storeOf(t, stores, addrs[0])
+	if _, err := owner.GetBlock(id); err != ErrNotFound {
+		t.Errorf("GetBlock of a missing block: %v", err)
+	}
+
+	//a holder that cannot be reached does not hide that the others
+	//answered without the block
+	storeOf(t, stores, addrs[1]).node.Finalize()
+	if _, err := owner.GetBlock(id); err != ErrNotFound {
+		t.Errorf("GetBlock of a missing block with a holder down: %v", err)
+	}
+}
+
+func TestGetBlockCorrupt(t *testing.T) {
+	nodes, stores := newRing(t, 19185, 3, WithReplicas(1))
+	data := []byte("block")
+	id, err := stores[0].PutBlock(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := nodes[0].LookupSuccessors(id, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, replica := storeOf(t, stores, addrs[0]), storeOf(t, stores, addrs[1])
+
+	//the corrupted copy of the owner is rejected, and the block is fetched
+	//from the replica and repaired on the owner
+	corrupt(t, owner, id)
+	if block, err := stores[0].GetBlock(id); err != nil || string(block) != string(data) {
+		t.Fatalf("GetBlock with a corrupted owner = %q, %v", block, err)
+	}
+	repaired := eventually(t, 10*time.Second, func() bool {
+		rec, ok, err := owner.load(blockKey(id))
+		if err != nil || !ok {
+			return false
+		}
+		for _, s := range rec.live() {
+			if string(s.value) != string(data) {
+				return false
+			}
+		}
+		return len(rec.live()) > 0
+	})
+	if !repaired {
+		t.Errorf("the owner's copy was not repaired")
+	}
+
+	corrupt(t, owner, id)
+	corrupt(t, replica, id)
+	if _, err := stores[0].GetBlock(id); err != ErrCorrupt {
+		t.Errorf("GetBlock with every copy corrupted: %v", err)
+	}
+}
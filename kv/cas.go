@@ -0,0 +1,188 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/golang/protobuf/proto"
+	"time"
+)
+
+//Conditional writes are coordinated by the node responsible for the key, which
+//checks the condition and writes atomically with respect to the other writes
+//it coordinates: Put, Delete, the writes made with a context and other
+//conditional writes. Quorum writes are coordinated by the node they are made
+//on and are not ordered with conditional writes; a key written with
+//QuorumPut or QuorumDelete may gain a sibling concurrent with a conditional
+//write that succeeded, so the two should not be mixed on the same key.
+
+//ErrConditionFailed is returned by a conditional write whose condition did not
+//hold. Nothing was written.
+var ErrConditionFailed = errors.New("condition failed")
+
+//A conditional write sent to a node that is no longer responsible for the key
+//is looked up and sent again, up to moveAttempts times, waiting moveBackoff
+//for the ring to settle after the first failed attempt and twice as long after
+//every other.
+const (
+	moveAttempts = 5
+	moveBackoff  = 100 * time.Millisecond
+)
+
+//PutIfAbsent stores value under key if the key has no value. Otherwise, the
+//error is ErrConditionFailed.
+func (kv *KV) PutIfAbsent(key string, value []byte) error {
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Put.Enum()
+	msg.Key = proto.String(key)
+	msg.Value = value
+	msg.Check = kvMsgs.KVMessage_Absent.Enum()
+	return kv.conditional(msg)
+}
+
+//PutIfVersion stores value under key if nothing was written to the key since
+//ctx was read with GetSiblings. Otherwise, the error is ErrConditionFailed.
+func (kv *KV) PutIfVersion(key string, value []byte, ctx Context) error {
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Put.Enum()
+	msg.Key = proto.String(key)
+	msg.Value = value
+	msg.Context = ctx.clock.encode()
+	msg.Versioned = proto.Bool(true)
+	msg.Check = kvMsgs.KVMessage_Version.Enum()
+	return kv.conditional(msg)
+}
+
+//CompareAndSwap stores value under key if the value of the key, as Get would
+//return it, is expected. Otherwise, including when the key has no value, the
+//error is ErrConditionFailed.
+func (kv *KV) CompareAndSwap(key string, expected []byte, value []byte) error {
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Put.Enum()
+	msg.Key = proto.String(key)
+	msg.Value = value
+	msg.Expected = expected
+	msg.Check = kvMsgs.KVMessage_Value.Enum()
+	return kv.conditional(msg)
+}
+
+//conditional sends the conditional write msg to the node responsible for its
+//key, looking the node up again if responsibility for the key moved
+func (kv *KV) conditional(msg *kvMsgs.KVMessage) error {
+	backoff := moveBackoff
+	for attempt := 0; attempt < moveAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		reply, err := kv.route(msg)
+		switch {
+		case err != nil:
+			return err
+		case reply.GetMoved():
+			continue
+		case reply.GetConflict():
+			return ErrConditionFailed
+		}
+		return nil
+	}
+	return fmt.Errorf("responsibility for %s kept moving after %d attempts", msg.GetKey(), moveAttempts)
+}
+
+//writeIf coordinates the conditional write msg on the node. The condition is
+//checked and the write made atomically with respect to the other writes the
+//node coordinates. If the node is not responsible for the key, or the
+//condition does not hold, nothing is written and reply says why. It returns
+//the record of the new sibling and whether it was written.
+func (kv *KV) writeIf(msg *kvMsgs.KVMessage, reply *kvMsgs.KVMessage) (record, bool, error) {
+	key := msg.GetKey()
+	if !kv.node.Responsible(Key(key)) {
+		reply.Moved = proto.Bool(true)
+		return record{}, false, nil
+	}
+	//the replicas are asked before taking the lock, since the requests
+	//the node sends them may wait for requests they send the node
+	if err := kv.catchUp(key); err != nil {
+		return record{}, false, err
+	}
+	kv.coordLock.Lock()
+	defer kv.coordLock.Unlock()
+	old, _, err := kv.load(key)
+	if err != nil {
+		return record{}, false, err
+	}
+
+	var ok bool
+	value, found := kv.resolve(old)
+	switch msg.GetCheck() {
+	case kvMsgs.KVMessage_Absent:
+		ok = !found
+	case kvMsgs.KVMessage_Version:
+		ok = old.clock().equal(decodeClock(msg.GetContext()))
+	case kvMsgs.KVMessage_Value:
+		ok = found && bytes.Equal(value, msg.GetExpected())
+	default:
+		return record{}, false, fmt.Errorf("unknown condition %d", msg.GetCheck())
+	}
+	if !ok {
+		reply.Conflict = proto.Bool(true)
+		return record{}, false, nil
+	}
+	deleted := msg.GetCmd() == kvMsgs.KVMessage_Delete
+	rec, err := kv.writeLocked(key, msg.GetValue(), deleted, time.Duration(msg.GetTtl()), old.clock())
+	return rec, err == nil, err
+}
+
+//catchUp merges the records of key held by the node's replicas into its own.
+//When the node has just taken over the key, the previous owner is among them,
+//and the conditions of writes must be checked against its record even if it
+//has yet to reach the node. Replicas that do not reply are skipped.
+func (kv *KV) catchUp(key string) error {
+	addrs := kv.Replicas()
+	if len(addrs) == 0 {
+		//without replication, the previous owner is the node's successor
+		if succ := kv.node.Successor(); succ.Addr() != "" && succ.Addr() != kv.node.Addr() {
+			addrs = []string{succ.Addr()}
+		}
+	}
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Get.Enum()
+	msg.Key = proto.String(key)
+	for _, addr := range addrs {
+		reply, err := kv.sendTo(msg, addr)
+		if err != nil || !reply.GetFound() {
+			continue
+		}
+		rec, err := replyRecord(reply)
+		if err != nil {
+			continue
+		}
+		if _, err := kv.store(key, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
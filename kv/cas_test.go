@@ -0,0 +1,244 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"context"
+	"fmt"
+	"github.com/cbocovic/chord"
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/golang/protobuf/proto"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConditions(t *testing.T) {
+	_, stores := newRing(t, 19160, 3, WithReplicas(1))
+	kv := stores[0]
+
+	if err := kv.PutIfAbsent("absent", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[1].PutIfAbsent("absent", []byte("b")); err != ErrConditionFailed {
+		t.Errorf("PutIfAbsent of a present key: %v", err)
+	}
+
+	if err := kv.CompareAndSwap("swap", []byte("x"), []byte("y")); err != ErrConditionFailed {
+		t.Errorf("CompareAndSwap of a missing key: %v", err)
+	}
+	if err := kv.Put("swap", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.CompareAndSwap("swap", []byte("z"), []byte("y")); err != ErrConditionFailed {
+		t.Errorf("CompareAndSwap with the wrong value: %v", err)
+	}
+	if err := stores[2].CompareAndSwap("swap", []byte("x"), []byte("y")); err != nil {
+		t.Errorf("CompareAndSwap with the right value: %v", err)
+	}
+
+	if err := kv.Put("version", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	_, ctx, err := kv.GetSiblings("version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[1].Put("version", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.PutIfVersion("version", []byte("3"), ctx); err != ErrConditionFailed {
+		t.Errorf("PutIfVersion with a stale context: %v", err)
+	}
+	if _, ctx, err = kv.GetSiblings("version"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.PutIfVersion("version", []byte("3"), ctx); err != nil {
+		t.Errorf("PutIfVersion with the latest context: %v", err)
+	}
+
+	for key, want := range map[string]string{"absent": "a", "swap": "y", "version": "3"} {
+		for i, kv := range stores {
+			if value, err := kv.Get(key); err != nil || string(value) != want {
+				t.Errorf("node %d: Get(%q) = %q, %v; want %q", i, key, value, err, want)
+			}
+		}
+	}
+}
+
+func TestConcurrentCompareAndSwap(t *testing.T) {
+	_, stores := newRing(t, 19165, 3, WithReplicas(1))
+	if err := stores[0].Put("race", []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	//exactly one of the swaps from the same value succeeds
+	var wg sync.WaitGroup
+	wins := make(chan string, 12)
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value := fmt.Sprintf("v%d", i)
+			if err := stores[i%len(stores)].CompareAndSwap("race", []byte("0"), []byte(value)); err == nil {
+				wins <- value
+			} else if err != ErrConditionFailed {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(wins)
+	var winners []string
+	for value := range wins {
+		winners = append(winners, value)
+	}
+	if len(winners) != 1 {
+		t.Fatalf("%d swaps succeeded: %v", len(winners), winners)
+	}
+	if value, err := stores[1].Get("race"); err != nil || string(value) != winners[0] {
+		t.Errorf("Get = %q, %v; want %q", value, err, winners[0])
+	}
+
+	//a counter incremented by swaps loses no increment
+	const increments = 10
+	for _, kv := range stores {
+		wg.Add(1)
+		go func(kv *KV) {
+			defer wg.Done()
+			for n := 0; n < increments; {
+				value, err := kv.Get("counter")
+				switch err {
+				case ErrNotFound:
+					err = kv.PutIfAbsent("counter", []byte("1"))
+				case nil:
+					count, _ := strconv.Atoi(string(value))
+					err = kv.CompareAndSwap("counter", value, []byte(strconv.Itoa(count+1)))
+				default:
+					t.Error(err)
+					return
+				}
+				if err == nil {
+					n++
+				} else if err != ErrConditionFailed {
+					t.Error(err)
+					return
+				}
+			}
+		}(kv)
+	}
+	wg.Wait()
+	want := strconv.Itoa(increments * len(stores))
+	if value, err := stores[0].Get("counter"); err != nil || string(value) != want {
+		t.Errorf("counter = %q, %v; want %s", value, err, want)
+	}
+}
+
+func TestCompareAndSwapRacingPut(t *testing.T) {
+	_, stores := newRing(t, 19170, 3, WithReplicas(1))
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := stores[0].Put(key, []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+
+		//the swap succeeds only if it is ordered before the write, which
+		//then replaces it, so the write is always the value left
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := stores[1].Put(key, []byte("put")); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			err := stores[2].CompareAndSwap(key, []byte("old"), []byte("swapped"))
+			if err != nil && err != ErrConditionFailed {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+		values, _, err := stores[0].GetSiblings(key)
+		if err != nil || len(values) != 1 || string(values[0]) != "put" {
+			t.Errorf("%s holds %q, %v; want the written value alone", key, values, err)
+		}
+	}
+}
+
+func TestConditionalMoved(t *testing.T) {
+	nodes, stores := newRing(t, 19175, 3, WithReplicas(1))
+	opts := []chord.Option{chord.WithBits(16), chord.WithSuccessors(3), chord.WithoutMaintenance(), chord.WithTimeout(time.Second)}
+	node, err := chord.Join("127.0.0.1:19178", []string{nodes[0].Addr()}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(node.Finalize)
+	joined, err := New(node, 7, nil, WithReplicas(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a key the new node takes over from its successor
+	succ := storeOf(t, stores, node.Successor().Addr())
+	taken := chord.Range{Start: succ.node.Predecessor().ID(), End: node.ID()}
+	var key string
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("key%d", i); taken.Contains(node.Reduce(Key(k))) {
+			key = k
+		}
+	}
+
+	//once the new node notified its successor, the successor sends the
+	//conditional writes of the key back to be looked up again
+	node.Stabilize()
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Put.Enum()
+	msg.Key = proto.String(key)
+	msg.Check = kvMsgs.KVMessage_Absent.Enum()
+	reply := new(kvMsgs.KVMessage)
+	if _, written, err := succ.writeIf(msg, reply); err != nil || written || !reply.GetMoved() {
+		t.Fatalf("writeIf on the previous owner = %v, %v, moved %v", written, err, reply.GetMoved())
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- stores[0].PutIfAbsent(key, []byte("v"))
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := chord.ConvergeRing(ctx, append(nodes, node)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("PutIfAbsent while the key moved: %v", err)
+	}
+	if !held(joined, key) {
+		t.Errorf("the new owner does not hold %s", key)
+	}
+	if value, err := stores[1].Get(key); err != nil || string(value) != "v" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+}
@@ -0,0 +1,385 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+//Package kv is a distributed key-value store that runs as an application on
+//top of a Chord DHT. Every key is stored on the node responsible for the
+//SHA-256 hash of the key. Keys starting with "block/" are reserved for the
+//content-addressed blocks of PutBlock.
+package kv
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/cbocovic/chord"
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/cbocovic/chord/storage"
+	"github.com/golang/protobuf/proto"
+	"log"
+	"sync"
+	"time"
+)
+
+//ErrNotFound is returned by Get if the key is not stored in the DHT.
+var ErrNotFound = errors.New("key not found")
+
+//errMalformed is the cause of the error returned when a peer's reply does not
+//match the request
+var errMalformed = errors.New("malformed reply")
+
+//DefaultReplicas is the number of successors that keep a copy of each key
+//unless WithReplicas is given.
+const DefaultReplicas = 2
+
+//Default retry settings for transfers of keys to other nodes.
+const (
+	DefaultTransferAttempts   = 5
+	DefaultTransferBackoff    = 100 * time.Millisecond
+	DefaultTransferMaxBackoff = 10 * time.Second
+)
+
+//DefaultAntiEntropyInterval is the interval between rounds of anti-entropy
+//unless WithAntiEntropy is given.
+const DefaultAntiEntropyInterval = time.Minute
+
+//KV is a key-value store application registered with a ChordNode.
+type KV struct {
+	node     *chord.ChordNode
+	app      byte
+	engine   storage.Engine
+	replicas int
+
+	//holders are the successors that currently hold copies of the keys the
+	//node owns
+	holders     []string
+	holdersLock sync.Mutex
+
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	aeInterval time.Duration
+	limiter    limiter
+
+	//writeLock orders the writes to the storage engine
+	writeLock sync.Mutex
+	//coordLock orders the writes the node coordinates, so that the
+	//conditions of conditional writes hold when they are written
+	coordLock sync.Mutex
+	//counter is the counter of the last write the node coordinated
+	counter     uint64
+	counterLock sync.Mutex
+
+	//n, w and r are the parameters of the quorum operations
+	n, w, r int
+
+	merge MergeFunc
+
+	reapInterval time.Duration
+	grace        time.Duration
+	//stale holds the time each stored key outside the range the node
+	//keeps was first found there by the reaper
+	stale     map[string]uint64
+	staleLock sync.Mutex
+
+	chunkSize int
+}
+
+//Option configures a KV created with New.
+type Option func(kv *KV)
+
+//WithReplicas sets the number of successors that keep a copy of every key the
+//node is responsible for. Zero disables replication.
+func WithReplicas(r int) Option {
+	return func(kv *KV) {
+		if r >= 0 {
+			kv.replicas = r
+		}
+	}
+}
+
+//WithTransferRetry sets how often a transfer of keys to another node is
+//attempted, and the backoff between attempts, which doubles after every
+//failure up to max. Every attempt resumes where the previous one stopped.
+func WithTransferRetry(attempts int, backoff time.Duration, max time.Duration) Option {
+	return func(kv *KV) {
+		if attempts > 0 {
+			kv.attempts = attempts
+		}
+		if backoff > 0 {
+			kv.backoff = backoff
+		}
+		if max >= kv.backoff {
+			kv.maxBackoff = max
+		}
+	}
+}
+
+//WithAntiEntropy sets the interval between rounds of anti-entropy with the
+//replicas, and caps the bandwidth they use at bandwidth bytes per second. An
+//interval of zero disables the background rounds, leaving Synchronize to the
+//application, and a bandwidth of zero leaves the bandwidth unlimited.
+func WithAntiEntropy(interval time.Duration, bandwidth int) Option {
+	return func(kv *KV) {
+		if interval >= 0 {
+			kv.aeInterval = interval
+		}
+		if bandwidth >= 0 {
+			kv.limiter.rate = bandwidth
+		}
+	}
+}
+
+//New registers a key-value store with node under the application identifier
+//app. Keys the node is responsible for are kept in engine, together with the
+//copies it holds for its predecessors. If engine is nil, the keys are kept in
+//memory.
+func New(node *chord.ChordNode, app byte, engine storage.Engine, opts ...Option) (*KV, error) {
+	if engine == nil {
+		engine = storage.NewMemory()
+	}
+	kv := &KV{node: node, app: app, engine: engine, replicas: DefaultReplicas}
+	kv.attempts = DefaultTransferAttempts
+	kv.backoff = DefaultTransferBackoff
+	kv.maxBackoff = DefaultTransferMaxBackoff
+	kv.aeInterval = DefaultAntiEntropyInterval
+	kv.reapInterval = DefaultReapInterval
+	kv.grace = DefaultExpiryGrace
+	kv.chunkSize = DefaultChunkSize
+	for _, opt := range opts {
+		opt(kv)
+	}
+	if kv.n == 0 {
+		kv.n = kv.replicas + 1
+		kv.w = kv.n/2 + 1
+		kv.r = kv.n/2 + 1
+	}
+	if !node.Register(app, kv) {
+		return nil, fmt.Errorf("application identifier %d is already in use", app)
+	}
+	done := make(chan struct{})
+	go kv.watch(node.Subscribe(16), done)
+	if kv.replicas > 0 && kv.aeInterval > 0 {
+		go kv.antiEntropy(done)
+	}
+	if kv.reapInterval > 0 {
+		go kv.reaper(done)
+	}
+	return kv, nil
+}
+
+//Key returns the identifier the DHT stores key under: the SHA-256 hash of the
+//key, or the hash of the block for the keys of blocks.
+func Key(key string) chord.ID {
+	if id, ok := blockID(key); ok {
+		return id
+	}
+	return chord.ID(sha256.Sum256([]byte(key)))
+}
+
+//entry returns the storage entry for value stored under key
+func (kv *KV) entry(key string, value []byte) storage.Entry {
+	return storage.Entry{ID: kv.node.Reduce(Key(key)), Key: key, Value: value}
+}
+
+//Put stores value under key on the node responsible for it, replacing every
+//value the key had.
+func (kv *KV) Put(key string, value []byte) error {
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Put.Enum()
+	msg.Key = proto.String(key)
+	msg.Value = value
+	_, err := kv.route(msg)
+	return err
+}
+
+//Get returns the value stored under key. If concurrent writes left several
+//values, they are combined by the merge function given to WithMerge, or the
+//latest one is returned. If there is none, the error is ErrNotFound.
+func (kv *KV) Get(key string) ([]byte, error) {
+	rec, err := kv.get(key)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := kv.resolve(rec)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+//Delete removes key from the DHT.
+func (kv *KV) Delete(key string) error {
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Delete.Enum()
+	msg.Key = proto.String(key)
+	_, err := kv.route(msg)
+	return err
+}
+
+//get returns the record of key held by the node responsible for it
+func (kv *KV) get(key string) (record, error) {
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Get.Enum()
+	msg.Key = proto.String(key)
+	reply, err := kv.route(msg)
+	if err != nil {
+		return record{}, err
+	}
+	if !reply.GetFound() {
+		return record{}, nil
+	}
+	return replyRecord(reply)
+}
+
+//route sends msg to the node responsible for its key and returns the reply
+func (kv *KV) route(msg *kvMsgs.KVMessage) (*kvMsgs.KVMessage, error) {
+	addr, err := kv.node.Lookup(Key(msg.GetKey()))
+	if err != nil {
+		return nil, err
+	}
+	return kv.sendTo(msg, addr)
+}
+
+//send sends msg to the key-value store at addr and returns its reply
+func (kv *KV) send(msg *kvMsgs.KVMessage, addr string) (*kvMsgs.KVMessage, error) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	data, err = kv.node.SendApp(kv.app, data, addr)
+	if err != nil {
+		return nil, err
+	}
+	reply := new(kvMsgs.KVMessage)
+	if err := proto.Unmarshal(data, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+//handle executes msg on the local store and returns the reply. Writes that do
+//not come from another node that holds the key are coordinated by the node,
+//which gives them a vector clock and passes them on to its replicas.
+func (kv *KV) handle(msg *kvMsgs.KVMessage) *kvMsgs.KVMessage {
+	reply := new(kvMsgs.KVMessage)
+	reply.Cmd = kvMsgs.KVMessage_Reply.Enum()
+
+	var err error
+	write := false
+	switch msg.GetCmd() {
+	case kvMsgs.KVMessage_Put, kvMsgs.KVMessage_Delete, kvMsgs.KVMessage_Refresh:
+		write = true
+		if msg.GetReplica() {
+			var rec record
+			if rec, err = decodeRecord(msg.GetRecord()); err == nil {
+				_, err = kv.store(msg.GetKey(), rec)
+			}
+		} else if msg.GetCmd() == kvMsgs.KVMessage_Refresh {
+			var rec record
+			var ok bool
+			rec, ok, err = kv.refresh(msg.GetKey(), time.Duration(msg.GetTtl()))
+			reply.Found = proto.Bool(ok)
+			msg = proto.Clone(msg).(*kvMsgs.KVMessage)
+			msg.Record = rec.encode()
+		} else if msg.Check != nil {
+			var rec record
+			rec, write, err = kv.writeIf(msg, reply)
+			msg = proto.Clone(msg).(*kvMsgs.KVMessage)
+			msg.Record = rec.encode()
+		} else {
+			//the node coordinates the write as the owner of the key
+			var ctx clock
+			if msg.GetVersioned() {
+				ctx = decodeClock(msg.GetContext())
+			}
+			var rec record
+			deleted := msg.GetCmd() == kvMsgs.KVMessage_Delete
+			rec, err = kv.write(msg.GetKey(), msg.GetValue(), deleted, time.Duration(msg.GetTtl()), ctx)
+			msg = proto.Clone(msg).(*kvMsgs.KVMessage)
+			msg.Record = rec.encode()
+		}
+	case kvMsgs.KVMessage_Get:
+		var rec record
+		var ok bool
+		rec, ok, err = kv.load(msg.GetKey())
+		reply.Found = proto.Bool(ok)
+		if ok {
+			reply.Record = rec.encode()
+		}
+	case kvMsgs.KVMessage_Transfer:
+		for _, item := range msg.GetItems() {
+			var rec record
+			if rec, err = decodeRecord(item.GetValue()); err != nil {
+				break
+			}
+			if _, err = kv.store(item.GetKey(), rec); err != nil {
+				break
+			}
+		}
+		write = true
+	case kvMsgs.KVMessage_Hashes:
+		for _, r := range msg.GetRanges() {
+			sum, count, herr := kv.hash(parseRange(r))
+			if err = herr; err != nil {
+				break
+			}
+			reply.Hashes = append(reply.Hashes, sum)
+			reply.Counts = append(reply.Counts, uint32(count))
+		}
+	case kvMsgs.KVMessage_Digests:
+		for _, r := range msg.GetRanges() {
+			if err = kv.digests(parseRange(r), msg.Key, reply); err != nil || reply.GetMore() {
+				break
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown command %d", msg.GetCmd())
+	}
+	if err != nil {
+		reply.Error = proto.String(err.Error())
+	} else if write && !msg.GetReplica() {
+		kv.replicate(msg)
+	}
+	return reply
+}
+
+//Message handles a request from the key-value store on another node.
+func (kv *KV) Message(data []byte) []byte {
+	msg := new(kvMsgs.KVMessage)
+	reply := new(kvMsgs.KVMessage)
+	if err := proto.Unmarshal(data, msg); err != nil {
+		reply.Cmd = kvMsgs.KVMessage_Reply.Enum()
+		reply.Error = proto.String(err.Error())
+	} else {
+		reply = kv.handle(msg)
+	}
+	data, err := proto.Marshal(reply)
+	if err != nil {
+		log.Fatal("marshaling error: ", err)
+	}
+	return data
+}
+
+//Notify is called when the node's predecessor changes.
+func (kv *KV) Notify(id [sha256.Size]byte, me [sha256.Size]byte, addr string) {
+}
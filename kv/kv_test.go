@@ -0,0 +1,281 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"context"
+	"fmt"
+	"github.com/cbocovic/chord"
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/cbocovic/chord/storage"
+	"github.com/golang/protobuf/proto"
+	"sync"
+	"testing"
+	"time"
+)
+
+//newRing starts n nodes listening on consecutive ports from port, each
+//running a KV, and converges their routing state
+func newRing(t *testing.T, port int, n int, opts ...Option) ([]*chord.ChordNode, []*KV) {
+	t.Helper()
+	chordOpts := []chord.Option{chord.WithBits(16), chord.WithSuccessors(3), chord.WithoutMaintenance(), chord.WithTimeout(time.Second)}
+	seed := fmt.Sprintf("127.0.0.1:%d", port)
+	var nodes []*chord.ChordNode
+	var stores []*KV
+	for i := 0; i < n; i++ {
+		var node *chord.ChordNode
+		if i == 0 {
+			node = chord.Create(seed, chordOpts...)
+		} else {
+			var err error
+			if node, err = chord.Join(fmt.Sprintf("127.0.0.1:%d", port+i), []string{seed}, chordOpts...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		kv, err := New(node, 7, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes, stores = append(nodes, node), append(stores, kv)
+		t.Cleanup(node.Finalize)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := chord.ConvergeRing(ctx, nodes...); err != nil {
+		t.Fatal(err)
+	}
+	return nodes, stores
+}
+
+func TestReplicatedPutGet(t *testing.T) {
+	_, stores := newRing(t, 19100, 3)
+
+	//every node writes at once, so that owners replicate to each other
+	//while handling writes
+	var wg sync.WaitGroup
+	errs := make(chan error, 60)
+	for i, kv := range stores {
+		wg.Add(1)
+		go func(i int, kv *KV) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				key := fmt.Sprintf("key%d-%d", i, j)
+				if err := kv.Put(key, []byte(key)); err != nil {
+					errs <- err
+				}
+			}
+		}(i, kv)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for i := range stores {
+		for j := 0; j < 20; j++ {
+			key := fmt.Sprintf("key%d-%d", i, j)
+			for _, kv := range stores {
+				value, err := kv.Get(key)
+				if err != nil || string(value) != key {
+					t.Fatalf("Get(%q) = %q, %v", key, value, err)
+				}
+			}
+			//with two replicas, each of the three nodes holds every key
+			for n, kv := range stores {
+				if _, ok, _ := kv.engine.Get(key); !ok {
+					t.Errorf("node %d holds no copy of %q", n, key)
+				}
+			}
+		}
+	}
+}
+
+func TestDigestsPaging(t *testing.T) {
+	nodes, stores := newRing(t, 19110, 1)
+	kv := stores[0]
+	var ids []chord.ID
+	for i := 0; i < 3000; i++ {
+		e := kv.entry(fmt.Sprintf("a-rather-long-key-to-fill-the-pages-%d", i), []byte{byte(i)})
+		if err := kv.engine.Put(e); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, e.ID)
+	}
+	whole := chord.Range{Start: nodes[0].ID(), End: nodes[0].ID()}
+	wrapped := chord.Range{Start: ids[0], End: ids[1]}
+
+	for _, r := range []chord.Range{whole, wrapped} {
+		want := make(map[string]bool)
+		kv.engine.Range(r, func(e storage.Entry) bool {
+			want[e.Key] = true
+			return true
+		})
+		got := make(map[string]bool)
+		var after *string
+		pages := 0
+		for {
+			reply := new(kvMsgs.KVMessage)
+			if err := kv.digests(r, after, reply); err != nil {
+				t.Fatal(err)
+			}
+			pages++
+			if size := proto.Size(reply); size > 2*transferBytes {
+				t.Errorf("reply of %d bytes", size)
+			}
+			for _, item := range reply.GetItems() {
+				if got[item.GetKey()] {
+					t.Errorf("%q listed twice", item.GetKey())
+				}
+				got[item.GetKey()] = true
+			}
+			if !reply.GetMore() {
+				break
+			}
+			after = proto.String(reply.GetItems()[len(reply.GetItems())-1].GetKey())
+		}
+		if len(got) != len(want) {
+			t.Errorf("%d of %d digests listed in %d pages", len(got), len(want), pages)
+		}
+		for key := range want {
+			if !got[key] {
+				t.Errorf("digest of %q missing", key)
+			}
+		}
+	}
+}
+
+func TestDropStale(t *testing.T) {
+	grace := time.Minute
+	_, stores := newRing(t, 19130, 4, WithReplicas(1), WithReaper(0, grace))
+	kv := stores[0]
+	held, ok := kv.heldRange()
+	if !ok {
+		t.Fatal("held range of a node in a ring of 4 is unknown")
+	}
+	var stray, kept string
+	for i := 0; stray == "" || kept == ""; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if held.Contains(kv.entry(key, nil).ID) {
+			if kept == "" {
+				kept = key
+			}
+		} else if stray == "" {
+			stray = key
+		}
+	}
+	for _, key := range []string{stray, kept} {
+		if err := kv.Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//a copy left behind from before the node stopped replicating the key
+	for _, other := range stores[1:] {
+		if e, ok, _ := other.engine.Get(stray); ok {
+			if err := kv.engine.Put(e); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if _, ok, _ := kv.engine.Get(stray); !ok {
+		t.Fatalf("no copy of %s in the ring", stray)
+	}
+
+	now := time.Now()
+	if err := kv.reapAt(uint64(now.UnixNano())); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := kv.engine.Get(stray); !ok {
+		t.Errorf("copy of %s dropped during the grace period", stray)
+	}
+	if err := kv.reapAt(uint64(now.Add(grace).UnixNano())); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := kv.engine.Get(stray); ok {
+		t.Errorf("copy of %s kept after the grace period", stray)
+	}
+	if _, ok, _ := kv.engine.Get(kept); !ok {
+		t.Errorf("%s dropped although the node holds it", kept)
+	}
+	if value, err := stores[2].Get(stray); err != nil || string(value) != stray {
+		t.Errorf("Get of %s = %q, %v", stray, value, err)
+	}
+}
+
+//eventually polls cond until it returns true. It returns false if cond does
+//not hold within timeout.
+func eventually(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return true
+}
+
+func TestRereplicateOnJoin(t *testing.T) {
+	nodes, stores := newRing(t, 19150, 3, WithReplicas(1))
+	var keys []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := stores[i%len(stores)].Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	//the new node changes the successor list of its predecessor, which
+	//copies its keys to the node
+	opts := []chord.Option{chord.WithBits(16), chord.WithSuccessors(3), chord.WithoutMaintenance(), chord.WithTimeout(time.Second)}
+	node, err := chord.Join("127.0.0.1:19153", []string{nodes[0].Addr()}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(node.Finalize)
+	kv, err := New(node, 7, nil, WithReplicas(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, stores = append(nodes, node), append(stores, kv)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := chord.ConvergeRing(ctx, nodes...); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		owner := ownerOf(t, stores, key)
+		replica := storeOf(t, stores, owner.Replicas()[0])
+		ok := eventually(t, 10*time.Second, func() bool {
+			return held(owner, key) && held(replica, key)
+		})
+		if !ok {
+			t.Errorf("%s is held by owner %s: %v, replica %s: %v", key,
+				owner.node.Addr(), held(owner, key), replica.node.Addr(), held(replica, key))
+		}
+	}
+}
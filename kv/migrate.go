@@ -0,0 +1,250 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cbocovic/chord"
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/cbocovic/chord/storage"
+	"github.com/golang/protobuf/proto"
+	"time"
+)
+
+//transferBatch is the largest number of keys sent in a single transfer
+//message, and transferBytes the size of their values past which no more keys
+//are added to it
+const (
+	transferBatch = 64
+	transferBytes = 32 << 10
+)
+
+//transfer streams the stored keys in a set of ranges to the node at addr in
+//batches, in the order the storage engine lists them. The destination
+//acknowledges every batch, and the last acknowledged entry is remembered so
+//that a failed transfer resumes without resending what already arrived.
+type transfer struct {
+	addr    string
+	ranges  []chord.Range
+	replica bool
+
+	//every key of ranges[:r] was sent, and the keys of ranges[r] up to
+	//and including last if started is true
+	r       int
+	last    storage.Entry
+	started bool
+	sent    int
+}
+
+//next returns the next batch of keys of the transfer and the entry of the
+//last one
+func (kv *KV) next(t *transfer) ([]*kvMsgs.Item, storage.Entry, error) {
+	var items []*kvMsgs.Item
+	var last storage.Entry
+	size := 0
+	for ; t.r < len(t.ranges); t.r, t.started = t.r+1, false {
+		r := t.ranges[t.r]
+		err := kv.engine.Range(r, func(e storage.Entry) bool {
+			if t.started && precedes(r, e, t.last) {
+				return true
+			}
+			items = append(items, item(e))
+			last = e
+			size += len(e.Value)
+			return len(items) < transferBatch && size < transferBytes
+		})
+		if err != nil || len(items) > 0 {
+			return items, last, err
+		}
+	}
+	return nil, last, nil
+}
+
+//precedes returns true if e is listed before last, or is last, when the
+//entries of r are listed
+func precedes(r chord.Range, e storage.Entry, last storage.Entry) bool {
+	switch {
+	case e.ID == last.ID:
+		return e.Key <= last.Key
+	case last.ID == r.Start:
+		//last is at the very end of a range covering the whole circle
+		return true
+	}
+	return chord.InRange(e.ID, r.Start, last.ID)
+}
+
+//run sends the remaining batches of t
+func (kv *KV) run(t *transfer) error {
+	for {
+		items, last, err := kv.next(t)
+		if err != nil || len(items) == 0 {
+			return err
+		}
+		msg := new(kvMsgs.KVMessage)
+		msg.Cmd = kvMsgs.KVMessage_Transfer.Enum()
+		msg.Items = items
+		msg.Replica = proto.Bool(t.replica)
+		reply, err := kv.send(msg, t.addr)
+		if err != nil {
+			return err
+		}
+		if reply.GetError() != "" {
+			return &chord.PeerError{Address: t.addr, Err: errors.New(reply.GetError())}
+		}
+		t.last, t.started = last, true
+		t.sent += len(items)
+	}
+}
+
+//retry runs t until it completes, giving up after the configured number of
+//attempts or as soon as valid returns false
+func (kv *KV) retry(t *transfer, valid func() bool) error {
+	backoff := kv.backoff
+	var err error
+	for attempt := 0; attempt < kv.attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > kv.maxBackoff {
+				backoff = kv.maxBackoff
+			}
+		}
+		if !valid() {
+			return fmt.Errorf("transfer to %s abandoned after %d keys: destination changed", t.addr, t.sent)
+		}
+		if err = kv.run(t); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("transfer to %s failed after %d keys: %s", t.addr, t.sent, err)
+}
+
+//migrate moves the keys in ranges to their new owner, the node's new
+//predecessor pred. The node keeps the keys as copies if it replicates data,
+//since the new owner's successor list starts with the node.
+func (kv *KV) migrate(ranges []chord.Range, pred chord.Finger) {
+	kv.move(ranges, pred.Addr(), func() bool {
+		return kv.node.Predecessor().Addr() == pred.Addr()
+	})
+}
+
+//move transfers the keys in ranges to the node at addr, giving up as soon as
+//valid returns false. Once they arrived, the keys are dropped unless the node
+//replicates data.
+func (kv *KV) move(ranges []chord.Range, addr string, valid func() bool) {
+	t := &transfer{addr: addr, ranges: ranges}
+	if err := kv.retry(t, valid); err != nil {
+		//the keys stay here until the next change of range
+		return
+	}
+	if kv.replicas == 0 {
+		kv.drop(ranges)
+	}
+}
+
+//drop deletes the stored keys in ranges, unless the node became responsible
+//for them again in the meantime. Nothing is deleted while the node's range is
+//unknown.
+func (kv *KV) drop(ranges []chord.Range) {
+	owned, ok := kv.node.OwnedRange()
+	if !ok {
+		return
+	}
+	var keys []string
+	for _, r := range ranges {
+		kv.engine.Range(r, func(e storage.Entry) bool {
+			if !owned.Contains(e.ID) {
+				keys = append(keys, e.Key)
+			}
+			return true
+		})
+	}
+	for _, key := range keys {
+		kv.engine.Delete(key)
+	}
+}
+
+//strays migrates the stored keys outside the node's range to the
+//predecessors responsible for them. A node may be given keys while its own
+//range is unknown, such as the range its successor lost to it right after it
+//joined. If other nodes joined before it in the meantime, each predecessor in
+//the node's predecessor list is sent the keys of its own range. The keys past
+//the last known predecessor go to that predecessor, which passes them on the
+//same way once it learns its own predecessor.
+//
+//A node that replicates data keeps copies of the ranges of its predecessors,
+//which their owners fetch by anti-entropy, so nothing is migrated.
+func (kv *KV) strays(pred chord.Finger) {
+	if kv.replicas > 0 {
+		return
+	}
+	owned, ok := kv.node.OwnedRange()
+	if !ok || owned.Start == owned.End || owned.Start != pred.ID() {
+		return
+	}
+	list := kv.node.PredecessorList()
+	for i, f := range list {
+		if f.Addr() == "" || f.Addr() == kv.node.Addr() {
+			return
+		}
+		//the range of the last known predecessor extends to the node
+		start := kv.node.ID()
+		if i+1 < len(list) && list[i+1].Addr() != "" {
+			start = list[i+1].ID()
+		}
+		addr := f.Addr()
+		kv.move([]chord.Range{{Start: start, End: f.ID()}}, addr, func() bool {
+			for _, p := range kv.node.PredecessorList() {
+				if p.Addr() == addr {
+					return true
+				}
+			}
+			return false
+		})
+		if start == kv.node.ID() {
+			return
+		}
+	}
+}
+
+//Leave hands the keys the node is responsible for to its successor, which
+//takes them over once the node has left. If the node's range is unknown, every
+//key it stores is handed over. Call Leave before Finalize to shut a node down
+//without losing data that is not replicated.
+func (kv *KV) Leave() error {
+	owned, ok := kv.node.OwnedRange()
+	if !ok {
+		owned = chord.Range{Start: kv.node.ID(), End: kv.node.ID()}
+	}
+	var err error = errors.New("no successor to hand keys to")
+	for _, f := range kv.node.SuccessorList() {
+		if f.Addr() == "" || f.Addr() == kv.node.Addr() {
+			continue
+		}
+		t := &transfer{addr: f.Addr(), ranges: []chord.Range{owned}}
+		if err = kv.retry(t, func() bool { return true }); err == nil {
+			return nil
+		}
+	}
+	return err
+}
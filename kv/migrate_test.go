@@ -0,0 +1,253 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"context"
+	"fmt"
+	"github.com/cbocovic/chord"
+	"testing"
+	"time"
+)
+
+//ownerOf returns the one of stores whose node is responsible for key
+func ownerOf(t *testing.T, stores []*KV, key string) *KV {
+	t.Helper()
+	for _, kv := range stores {
+		if kv.node.Responsible(Key(key)) {
+			return kv
+		}
+	}
+	t.Fatalf("no node is responsible for %s", key)
+	return nil
+}
+
+//storeOf returns the one of stores whose node has the address addr
+func storeOf(t *testing.T, stores []*KV, addr string) *KV {
+	t.Helper()
+	for _, kv := range stores {
+		if kv.node.Addr() == addr {
+			return kv
+		}
+	}
+	t.Fatalf("no node has the address %s", addr)
+	return nil
+}
+
+//held returns true if the storage engine of kv holds key
+func held(kv *KV, key string) bool {
+	_, ok, _ := kv.engine.Get(key)
+	return ok
+}
+
+func TestStraysGoToTheirOwners(t *testing.T) {
+	_, stores := newRing(t, 19140, 3, WithReplicas(0))
+	kv := stores[0]
+	preds := kv.node.PredecessorList()
+	first, second := storeOf(t, stores, preds[0].Addr()), storeOf(t, stores, preds[1].Addr())
+
+	//a key of each predecessor, held by the node as if it had been given
+	//them while its range was unknown
+	keys := make(map[*KV]string)
+	for i := 0; len(keys) < 2; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owner := ownerOf(t, stores, key)
+		if owner == kv || keys[owner] != "" {
+			continue
+		}
+		if err := kv.Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		e, _, err := owner.engine.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := kv.engine.Put(e); err != nil {
+			t.Fatal(err)
+		}
+		if err := owner.engine.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		keys[owner] = key
+	}
+
+	kv.strays(preds[0])
+	for owner, key := range keys {
+		if !held(owner, key) {
+			t.Errorf("%s did not reach its owner %s", key, owner.node.Addr())
+		}
+		if held(kv, key) {
+			t.Errorf("%s is still held by %s", key, kv.node.Addr())
+		}
+	}
+	if held(first, keys[second]) {
+		t.Errorf("the predecessor was sent %s outside its range", keys[second])
+	}
+}
+
+func TestStraysKeptWithReplicas(t *testing.T) {
+	_, stores := newRing(t, 19145, 3, WithReplicas(1))
+	kv := stores[0]
+	pred := kv.node.Predecessor()
+	var key string
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("key%d", i); ownerOf(t, stores, k) == storeOf(t, stores, pred.Addr()) {
+			key = k
+		}
+	}
+	if err := kv.Put(key, []byte(key)); err != nil {
+		t.Fatal(err)
+	}
+	owner := storeOf(t, stores, pred.Addr()).engine
+	if err := owner.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+
+	//the node keeps a copy for its predecessor, which the predecessor
+	//fetches by anti-entropy rather than by migration
+	kv.strays(pred)
+	if !held(kv, key) {
+		t.Errorf("the copy of %s was dropped", key)
+	}
+	if _, ok, _ := owner.Get(key); ok {
+		t.Errorf("%s was migrated to its owner although the node replicates it", key)
+	}
+}
+
+//checkOwners checks that each of keys ends up held by its owner among stores
+//and by no other node, as happens without replication
+func checkOwners(t *testing.T, stores []*KV, keys []string) {
+	t.Helper()
+	for _, key := range keys {
+		owner := ownerOf(t, stores, key)
+		ok := eventually(t, 10*time.Second, func() bool {
+			for _, kv := range stores {
+				if held(kv, key) != (kv == owner) {
+					return false
+				}
+			}
+			return true
+		})
+		if !ok {
+			t.Errorf("%s is not held by its owner %s alone", key, owner.node.Addr())
+		}
+		if value, err := stores[0].Get(key); err != nil || string(value) != key {
+			t.Errorf("Get(%q) = %q, %v", key, value, err)
+		}
+	}
+}
+
+//putKeys writes n keys through stores and returns them
+func putKeys(t *testing.T, stores []*KV, n int) []string {
+	t.Helper()
+	var keys []string
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := stores[i%len(stores)].Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestMigrateOnJoin(t *testing.T) {
+	nodes, stores := newRing(t, 19320, 2, WithReplicas(0))
+	keys := putKeys(t, stores, 40)
+
+	opts := []chord.Option{chord.WithBits(16), chord.WithSuccessors(3), chord.WithoutMaintenance(), chord.WithTimeout(time.Second)}
+	node, err := chord.Join("127.0.0.1:19322", []string{nodes[0].Addr()}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(node.Finalize)
+	kv, err := New(node, 7, nil, WithReplicas(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, stores = append(nodes, node), append(stores, kv)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := chord.ConvergeRing(ctx, nodes...); err != nil {
+		t.Fatal(err)
+	}
+	checkOwners(t, stores, keys)
+}
+
+func TestTransferResumes(t *testing.T) {
+	_, stores := newRing(t, 19325, 2, WithReplicas(0))
+	src, dst := stores[0], stores[1]
+	var keys []string
+	for i := 0; i < 3*transferBatch; i++ {
+		key := fmt.Sprintf("key%d", i)
+		rec := record{[]sibling{src.sibling([]byte(key), false, nil)}}
+		if err := src.engine.Put(src.entry(key, rec.encode())); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	//the first batch was acknowledged before the transfer was interrupted
+	tr := &transfer{addr: dst.node.Addr(), ranges: []chord.Range{{}}, replica: true}
+	first, last, err := src.next(tr)
+	if err != nil || len(first) != transferBatch {
+		t.Fatalf("first batch of %d keys, %v", len(first), err)
+	}
+	tr.last, tr.started, tr.sent = last, true, len(first)
+
+	if err := src.retry(tr, func() bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	if tr.sent != len(keys) {
+		t.Errorf("%d keys sent, want %d", tr.sent, len(keys))
+	}
+	sent := make(map[string]bool)
+	for _, item := range first {
+		sent[item.GetKey()] = true
+	}
+	for _, key := range keys {
+		if held(dst, key) == sent[key] {
+			t.Errorf("%s: held %v, in the acknowledged batch %v", key, held(dst, key), sent[key])
+		}
+	}
+}
+
+func TestLeave(t *testing.T) {
+	nodes, stores := newRing(t, 19330, 3, WithReplicas(0))
+	keys := putKeys(t, stores, 40)
+
+	leaving := stores[1]
+	if err := leaving.Leave(); err != nil {
+		t.Fatal(err)
+	}
+	leaving.node.Finalize()
+	nodes = append(nodes[:1], nodes[2:]...)
+	stores = append(stores[:1], stores[2:]...)
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := chord.ConvergeRing(ctx, nodes...); err != nil {
+		t.Fatal(err)
+	}
+	checkOwners(t, stores, keys)
+}
@@ -0,0 +1,285 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/cbocovic/chord"
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"log"
+)
+
+//Large objects are split into chunks that are stored as blocks, so that the
+//chunks of an object are spread over the ring, identical chunks are stored
+//once and every chunk is checked when it is read. The object's key holds a
+//manifest listing the hashes of its chunks in order. If an object has more
+//than manifestFanout chunks, their hashes are themselves stored in index
+//blocks of up to manifestFanout hashes each, as many levels deep as needed,
+//and the manifest lists the top level.
+const (
+	manifestFanout = 256
+	//maxChunkSize keeps a chunk, and its copies sent to the replicas, within
+	//a single message
+	maxChunkSize = 32 << 10
+)
+
+//DefaultChunkSize is the size of the chunks objects are split into unless
+//WithChunkSize is given.
+const DefaultChunkSize = 8 << 10
+
+//errClosed is returned by writes to an ObjectWriter that was closed
+var errClosed = errors.New("write to closed object")
+
+//WithChunkSize sets the size of the chunks objects are split into. It may not
+//exceed 32KiB.
+func WithChunkSize(size int) Option {
+	return func(kv *KV) {
+		if size > 0 && size <= maxChunkSize {
+			kv.chunkSize = size
+		}
+	}
+}
+
+//putChunk stores data as a block and returns its hash
+func (kv *KV) putChunk(data []byte) ([]byte, error) {
+	id, err := kv.PutBlock(data)
+	return id[:], err
+}
+
+//getChunk returns the block with hash sum
+func (kv *KV) getChunk(sum []byte) ([]byte, error) {
+	var id chord.ID
+	if len(sum) != len(id) {
+		return nil, ErrCorrupt
+	}
+	copy(id[:], sum)
+	return kv.GetBlock(id)
+}
+
+//PutObject stores the content read from r until EOF as an object under key,
+//replacing the value the key had. Nothing is stored under key if reading r
+//fails.
+func (kv *KV) PutObject(key string, r io.Reader) error {
+	w := kv.CreateObject(key)
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+//GetObject writes the content of the object stored under key to w.
+func (kv *KV) GetObject(key string, w io.Writer) error {
+	r, err := kv.OpenObject(key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+//ObjectWriter stores the content written to it as an object. The chunks are
+//stored as they fill up, so that only one chunk of the content is held in
+//memory, and the object only replaces the value of its key once the writer is
+//closed.
+type ObjectWriter struct {
+	kv   *KV
+	key  string
+	buf  []byte
+	size uint64
+
+	//chunks are the hashes of the chunks stored so far
+	chunks [][]byte
+	err    error
+	closed bool
+}
+
+//CreateObject returns a writer that stores an object under key.
+func (kv *KV) CreateObject(key string) *ObjectWriter {
+	w := &ObjectWriter{kv: kv, key: key}
+	w.buf = make([]byte, 0, kv.chunkSize)
+	return w
+}
+
+//Write adds p to the content of the object, storing every chunk that fills
+//up. It returns an error once storing one of the chunks failed.
+func (w *ObjectWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errClosed
+	}
+	n := 0
+	for n < len(p) && w.err == nil {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p[n:])
+		w.buf, n = w.buf[:len(w.buf)+m], n+m
+		if len(w.buf) == cap(w.buf) {
+			w.flush()
+		}
+	}
+	w.size += uint64(n)
+	return n, w.err
+}
+
+//Close stores the last chunk and the manifest of the object.
+func (w *ObjectWriter) Close() error {
+	if w.closed {
+		return errClosed
+	}
+	w.closed = true
+	if len(w.buf) > 0 {
+		w.flush()
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	hashes := w.chunks
+	depth := uint32(0)
+	for len(hashes) > manifestFanout {
+		var index [][]byte
+		for i := 0; i < len(hashes); i += manifestFanout {
+			end := i + manifestFanout
+			if end > len(hashes) {
+				end = len(hashes)
+			}
+			sum, err := w.kv.putChunk(bytes.Join(hashes[i:end], nil))
+			if err != nil {
+				return err
+			}
+			index = append(index, sum)
+		}
+		hashes = index
+		depth++
+	}
+
+	m := new(kvMsgs.Manifest)
+	m.Size = proto.Uint64(w.size)
+	m.Depth = proto.Uint32(depth)
+	m.Chunks = hashes
+	data, err := proto.Marshal(m)
+	if err != nil {
+		log.Fatal("marshaling error: ", err)
+	}
+	return w.kv.Put(w.key, data)
+}
+
+//flush stores the buffered content as the next chunk
+func (w *ObjectWriter) flush() {
+	var sum []byte
+	if sum, w.err = w.kv.putChunk(w.buf); w.err == nil {
+		//the stored chunk may still refer to the buffer
+		w.chunks = append(w.chunks, sum)
+		w.buf = make([]byte, 0, w.kv.chunkSize)
+	}
+}
+
+//ObjectReader reads the content of an object, fetching its chunks as they
+//are needed.
+type ObjectReader struct {
+	kv   *KV
+	size uint64
+	read uint64
+
+	//levels holds, for every level of the object's index from the manifest
+	//down to the chunks of content, the hashes still to be read
+	levels [][][]byte
+	buf    []byte
+	err    error
+}
+
+//OpenObject returns a reader of the object stored under key. If concurrent
+//writes left several objects, the one written last is read.
+func (kv *KV) OpenObject(key string) (*ObjectReader, error) {
+	rec, err := kv.get(key)
+	if err != nil {
+		return nil, err
+	}
+	live := rec.live()
+	if len(live) == 0 {
+		return nil, ErrNotFound
+	}
+	m := new(kvMsgs.Manifest)
+	if err := proto.Unmarshal(latest(live).value, m); err != nil {
+		return nil, fmt.Errorf("%s is not an object: %s", key, err)
+	}
+	r := &ObjectReader{kv: kv, size: m.GetSize()}
+	r.levels = make([][][]byte, m.GetDepth()+1)
+	r.levels[0] = m.GetChunks()
+	return r, nil
+}
+
+//Size returns the size of the object.
+func (r *ObjectReader) Size() int64 {
+	return int64(r.size)
+}
+
+//Read reads the next part of the object into p.
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		sum, err := r.next(len(r.levels) - 1)
+		if err == io.EOF && r.read != r.size {
+			err = ErrCorrupt
+		}
+		if err == nil {
+			r.buf, err = r.kv.getChunk(sum)
+			r.read += uint64(len(r.buf))
+		}
+		r.err = err
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+//next returns the next hash of the given level of the object's index,
+//fetching the index block it is listed in if needed
+func (r *ObjectReader) next(level int) ([]byte, error) {
+	for len(r.levels[level]) == 0 {
+		if level == 0 {
+			return nil, io.EOF
+		}
+		sum, err := r.next(level - 1)
+		if err != nil {
+			return nil, err
+		}
+		index, err := r.kv.getChunk(sum)
+		if err != nil {
+			return nil, err
+		}
+		if len(index)%sha256.Size != 0 {
+			return nil, ErrCorrupt
+		}
+		for i := 0; i < len(index); i += sha256.Size {
+			r.levels[level] = append(r.levels[level], index[i:i+sha256.Size])
+		}
+	}
+	sum := r.levels[level][0]
+	r.levels[level] = r.levels[level][1:]
+	return sum, nil
+}
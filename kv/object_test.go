@@ -0,0 +1,163 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/cbocovic/chord"
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+//manifest returns the manifest of the object stored under key
+func manifest(t *testing.T, kv *KV, key string) *kvMsgs.Manifest {
+	t.Helper()
+	data, err := kv.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(kvMsgs.Manifest)
+	if err := proto.Unmarshal(data, m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+//putManifest replaces the manifest of the object stored under key with m
+func putManifest(t *testing.T, kv *KV, key string, m *kvMsgs.Manifest) {
+	t.Helper()
+	data, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Put(key, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestObjectRoundTrip(t *testing.T) {
+	const chunk = 16
+	_, stores := newRing(t, 19340, 3, WithReplicas(1), WithChunkSize(chunk))
+
+	//more chunks than a manifest lists, so that they are indexed
+	content := make([]byte, chunk*(manifestFanout+44)+5)
+	for i := range content {
+		content[i] = byte(i * 7 / chunk)
+	}
+	w := stores[0].CreateObject("object")
+	for rest := content; len(rest) > 0; {
+		n := 100
+		if n > len(rest) {
+			n = len(rest)
+		}
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if _, err := stores[1].Get("object"); err != ErrNotFound {
+		t.Errorf("the object is visible before the writer is closed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("more")); err != errClosed {
+		t.Errorf("Write after Close: %v", err)
+	}
+	if m := manifest(t, stores[0], "object"); m.GetDepth() != 1 || len(m.GetChunks()) != 2 {
+		t.Errorf("manifest of depth %d listing %d hashes, want 1 and 2", m.GetDepth(), len(m.GetChunks()))
+	}
+
+	r, err := stores[2].OpenObject("object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(content)) {
+		t.Errorf("Size = %d, want %d", r.Size(), len(content))
+	}
+	var got bytes.Buffer
+	buf := make([]byte, 7)
+	for {
+		n, err := r.Read(buf)
+		got.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got.Bytes(), content) {
+		t.Errorf("read %d bytes that differ from the %d written", got.Len(), len(content))
+	}
+
+	got.Reset()
+	if err := stores[1].GetObject("object", &got); err != nil || !bytes.Equal(got.Bytes(), content) {
+		t.Errorf("GetObject returned %d bytes, %v", got.Len(), err)
+	}
+}
+
+func TestObjectCorrupt(t *testing.T) {
+	_, stores := newRing(t, 19345, 3, WithReplicas(1), WithChunkSize(16))
+	kv := stores[0]
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	if err := kv.PutObject("object", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	m := manifest(t, kv, "object")
+
+	//an object shorter than its manifest says
+	short := proto.Clone(m).(*kvMsgs.Manifest)
+	short.Size = proto.Uint64(m.GetSize() + 1)
+	putManifest(t, kv, "short", short)
+	if err := kv.GetObject("short", ioutil.Discard); err != ErrCorrupt {
+		t.Errorf("GetObject of a short object: %v", err)
+	}
+
+	//an index block whose length is not a whole number of hashes
+	index, err := kv.PutBlock(make([]byte, sha256.Size+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := &kvMsgs.Manifest{Size: m.Size, Depth: proto.Uint32(1), Chunks: [][]byte{index[:]}}
+	putManifest(t, kv, "index", bad)
+	if err := kv.GetObject("index", ioutil.Discard); err != ErrCorrupt {
+		t.Errorf("GetObject with a malformed index: %v", err)
+	}
+
+	//a chunk whose every copy was corrupted
+	var id chord.ID
+	copy(id[:], m.GetChunks()[1])
+	for _, store := range stores {
+		if held(store, blockKey(id)) {
+			corrupt(t, store, id)
+		}
+	}
+	if err := kv.GetObject("object", ioutil.Discard); err != ErrCorrupt {
+		t.Errorf("GetObject with a corrupted chunk: %v", err)
+	}
+}
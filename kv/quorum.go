@@ -0,0 +1,238 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/golang/protobuf/proto"
+)
+
+//QuorumError is returned by the quorum operations if fewer of the nodes that
+//hold a key replied than the operation needs.
+type QuorumError struct {
+	Needed  int
+	Replies int
+	Errors  []error
+}
+
+func (e *QuorumError) Error() string {
+	msg := fmt.Sprintf("%d of %d replies needed for a quorum", e.Replies, e.Needed)
+	for _, err := range e.Errors {
+		msg += "; " + err.Error()
+	}
+	return msg
+}
+
+//WithQuorum sets the parameters of the quorum operations: a key is held by
+//the first n nodes that succeed it on the ring, writes must be acknowledged by
+//w of them and reads merge the replies of r of them. Reads are guaranteed to
+//see the latest completed write if r+w > n. By default n is the number of
+//replicas plus one, and w and r are majorities of n.
+func WithQuorum(n int, w int, r int) Option {
+	return func(kv *KV) {
+		if n > 0 && w > 0 && w <= n && r > 0 && r <= n {
+			kv.n, kv.w, kv.r = n, w, r
+		}
+	}
+}
+
+//response is the reply of one of the nodes that hold a key
+type response struct {
+	addr  string
+	reply *kvMsgs.KVMessage
+	err   error
+}
+
+//QuorumPut stores value under key on the first n nodes that succeed it and
+//returns once w of them stored it. The write replaces the values found by a
+//quorum read of the key; values written concurrently are kept as siblings.
+//Quorum writes are not ordered with the conditional writes of the key, which
+//should not be mixed with them.
+func (kv *KV) QuorumPut(key string, value []byte) error {
+	return kv.quorumWrite(key, value, false)
+}
+
+//QuorumDelete removes key from the first n nodes that succeed it and returns
+//once w of them removed it. Like QuorumPut, it is not ordered with the
+//conditional writes of the key.
+func (kv *KV) QuorumDelete(key string) error {
+	return kv.quorumWrite(key, nil, true)
+}
+
+//quorumWrite coordinates a write of key on the node. It reads the record of
+//the key from a quorum to learn which siblings the write replaces, then sends
+//the new sibling to the nodes that hold the key.
+func (kv *KV) quorumWrite(key string, value []byte, deleted bool) error {
+	rec, err := kv.quorumRead(key)
+	if err != nil {
+		return err
+	}
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Put.Enum()
+	if deleted {
+		msg.Cmd = kvMsgs.KVMessage_Delete.Enum()
+	}
+	msg.Key = proto.String(key)
+	msg.Record = record{[]sibling{kv.sibling(value, deleted, rec.clock())}}.encode()
+	msg.Replica = proto.Bool(true)
+	addrs, err := kv.node.LookupSuccessors(Key(key), kv.n)
+	if err != nil {
+		return err
+	}
+	responses := kv.broadcast(msg, addrs)
+	qerr := &QuorumError{Needed: kv.w}
+	for range addrs {
+		resp := <-responses
+		if resp.err != nil {
+			qerr.Errors = append(qerr.Errors, resp.err)
+			continue
+		}
+		if qerr.Replies++; qerr.Replies == kv.w {
+			return nil
+		}
+	}
+	return qerr
+}
+
+//QuorumGet returns the value stored under key, merging the records of r of
+//the first n nodes that succeed it. Like Get, it combines the values left by
+//concurrent writes. The nodes found to hold an incomplete record, including
+//the ones that reply after the read returned, are repaired with the merged
+//record. If the key does not exist, the error is ErrNotFound.
+func (kv *KV) QuorumGet(key string) ([]byte, error) {
+	rec, err := kv.quorumRead(key)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := kv.resolve(rec)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+//quorumRead returns the merged records of key held by r of the first n nodes
+//that succeed it, and repairs the nodes that hold an incomplete record
+func (kv *KV) quorumRead(key string) (record, error) {
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Get.Enum()
+	msg.Key = proto.String(key)
+	addrs, err := kv.node.LookupSuccessors(Key(key), kv.n)
+	if err != nil {
+		return record{}, err
+	}
+	responses := kv.broadcast(msg, addrs)
+
+	var merged record
+	var replies []response
+	qerr := &QuorumError{Needed: kv.r}
+	for len(replies)+len(qerr.Errors) < len(addrs) && len(replies) < kv.r {
+		resp := <-responses
+		var rec record
+		if resp.err == nil {
+			rec, resp.err = replyRecord(resp.reply)
+		}
+		if resp.err != nil {
+			qerr.Errors = append(qerr.Errors, resp.err)
+			continue
+		}
+		replies = append(replies, resp)
+		merged = merged.merge(rec)
+	}
+	if len(replies) < kv.r {
+		qerr.Replies = len(replies)
+		return record{}, qerr
+	}
+
+	pending := len(addrs) - len(replies) - len(qerr.Errors)
+	go kv.readRepair(key, merged, replies, responses, pending)
+	return merged, nil
+}
+
+//readRepair sends merged to the nodes in replies whose record for key lacks
+//some of its siblings, as well as to the pending nodes that have yet to reply
+func (kv *KV) readRepair(key string, merged record, replies []response, responses chan response, pending int) {
+	for i := 0; i < pending; i++ {
+		resp := <-responses
+		if resp.err == nil {
+			replies = append(replies, resp)
+		}
+	}
+	records := make([]record, 0, len(replies))
+	for _, resp := range replies {
+		rec, err := replyRecord(resp.reply)
+		if err != nil {
+			rec = record{}
+		}
+		records = append(records, rec)
+		merged = merged.merge(rec)
+	}
+	if len(merged.siblings) == 0 {
+		return
+	}
+
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Put.Enum()
+	msg.Key = proto.String(key)
+	msg.Record = merged.encode()
+	msg.Replica = proto.Bool(true)
+	for i, resp := range replies {
+		if !bytes.Equal(records[i].encode(), msg.Record) {
+			kv.sendTo(msg, resp.addr)
+		}
+	}
+}
+
+//broadcast sends msg to each of addrs at once. The responses arrive on the
+//returned channel in the order the nodes reply.
+func (kv *KV) broadcast(msg *kvMsgs.KVMessage, addrs []string) chan response {
+	responses := make(chan response, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			reply, err := kv.sendTo(msg, addr)
+			responses <- response{addr, reply, err}
+		}(addr)
+	}
+	return responses
+}
+
+//sendTo sends msg to the key-value store at addr, which may be the node
+//itself, and returns its reply. A reply that reports an error is returned as
+//an error.
+func (kv *KV) sendTo(msg *kvMsgs.KVMessage, addr string) (*kvMsgs.KVMessage, error) {
+	var reply *kvMsgs.KVMessage
+	if addr == kv.node.Addr() {
+		reply = kv.handle(msg)
+	} else {
+		var err error
+		if reply, err = kv.send(msg, addr); err != nil {
+			return nil, err
+		}
+	}
+	if reply.GetError() != "" {
+		return nil, fmt.Errorf("%s: %s", addr, reply.GetError())
+	}
+	return reply, nil
+}
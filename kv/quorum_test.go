@@ -0,0 +1,133 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"testing"
+	"time"
+)
+
+//holders returns the stores of the n nodes that hold key, starting with its
+//owner
+func holders(t *testing.T, stores []*KV, key string, n int) []*KV {
+	t.Helper()
+	addrs, err := stores[0].node.LookupSuccessors(Key(key), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kvs []*KV
+	for _, addr := range addrs {
+		kvs = append(kvs, storeOf(t, stores, addr))
+	}
+	return kvs
+}
+
+func TestQuorumPutGet(t *testing.T) {
+	_, stores := newRing(t, 19300, 3)
+	if err := stores[0].QuorumPut("key", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	for i, kv := range stores {
+		if value, err := kv.QuorumGet("key"); err != nil || string(value) != "v1" {
+			t.Errorf("node %d: QuorumGet = %q, %v", i, value, err)
+		}
+	}
+	if err := stores[1].QuorumDelete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stores[2].QuorumGet("key"); err != ErrNotFound {
+		t.Errorf("QuorumGet of a deleted key: %v", err)
+	}
+
+	//with one of the three holders down, w = r = 2 are still met
+	kvs := holders(t, stores, "key", 3)
+	owner := kvs[0]
+	kvs[2].node.Finalize()
+	if err := owner.QuorumPut("key", []byte("v2")); err != nil {
+		t.Fatalf("QuorumPut with a holder down: %v", err)
+	}
+	if value, err := owner.QuorumGet("key"); err != nil || string(value) != "v2" {
+		t.Errorf("QuorumGet with a holder down = %q, %v", value, err)
+	}
+
+	//with two down, a read cannot reach r
+	kvs[1].node.Finalize()
+	_, err := owner.QuorumGet("key")
+	qerr, ok := err.(*QuorumError)
+	if !ok || qerr.Needed != 2 || qerr.Replies != 1 || len(qerr.Errors) != 2 {
+		t.Errorf("QuorumGet with two holders down: %#v", err)
+	}
+}
+
+func TestQuorumPartialWrite(t *testing.T) {
+	//every holder must acknowledge a write, while a read needs one reply
+	_, stores := newRing(t, 19305, 3, WithQuorum(3, 3, 1))
+	kvs := holders(t, stores, "key", 3)
+	owner := kvs[0]
+	if err := owner.QuorumPut("key", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	kvs[1].node.Finalize()
+	err := owner.QuorumPut("key", []byte("v2"))
+	qerr, ok := err.(*QuorumError)
+	if !ok || qerr.Needed != 3 || qerr.Replies != 2 || len(qerr.Errors) != 1 {
+		t.Fatalf("QuorumPut with a holder down: %#v", err)
+	}
+	//the write was not undone on the holders that acknowledged it
+	if value, err := owner.QuorumGet("key"); err != nil || string(value) != "v2" {
+		t.Errorf("QuorumGet after a partial write = %q, %v", value, err)
+	}
+}
+
+func TestQuorumReadRepair(t *testing.T) {
+	_, stores := newRing(t, 19310, 3)
+	if err := stores[0].QuorumPut("key", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	kvs := holders(t, stores, "key", 3)
+
+	//a replica that missed the last write is repaired by a read
+	stale := kvs[2]
+	old, _, err := stale.load("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[1].QuorumPut("key", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.engine.Put(stale.entry("key", old.encode())); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := stores[0].QuorumGet("key"); err != nil || string(value) != "v2" {
+		t.Fatalf("QuorumGet = %q, %v", value, err)
+	}
+	repaired := eventually(t, 10*time.Second, func() bool {
+		rec, _, err := stale.load("key")
+		value, ok := stale.resolve(rec)
+		return err == nil && ok && string(value) == "v2"
+	})
+	if !repaired {
+		t.Errorf("the stale replica %s was not repaired", stale.node.Addr())
+	}
+}
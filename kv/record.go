@@ -0,0 +1,368 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"bytes"
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/cbocovic/chord/storage"
+	"github.com/golang/protobuf/proto"
+	"log"
+	"sort"
+	"time"
+)
+
+//clock is a vector clock: for every node that coordinated a write in the
+//history of a value, the counter of its latest write. Counters are taken
+//from the coordinator's clock, so they also order the writes of a node in
+//time.
+type clock map[string]uint64
+
+//equal returns true if c and o have seen the same writes
+func (c clock) equal(o clock) bool {
+	if len(c) != len(o) {
+		return false
+	}
+	for node, counter := range c {
+		if o[node] != counter {
+			return false
+		}
+	}
+	return true
+}
+
+//merge returns the clock that has seen every write c or o has seen
+func (c clock) merge(o clock) clock {
+	m := make(clock, len(c))
+	for node, counter := range c {
+		m[node] = counter
+	}
+	for node, counter := range o {
+		if m[node] < counter {
+			m[node] = counter
+		}
+	}
+	return m
+}
+
+//encode returns the entries of c in a canonical order
+func (c clock) encode() []*kvMsgs.ClockEntry {
+	nodes := make([]string, 0, len(c))
+	for node := range c {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	entries := make([]*kvMsgs.ClockEntry, len(nodes))
+	for i, node := range nodes {
+		entries[i] = new(kvMsgs.ClockEntry)
+		entries[i].Node = proto.String(node)
+		entries[i].Counter = proto.Uint64(c[node])
+	}
+	return entries
+}
+
+func decodeClock(entries []*kvMsgs.ClockEntry) clock {
+	c := make(clock, len(entries))
+	for _, e := range entries {
+		c[e.GetNode()] = e.GetCounter()
+	}
+	return c
+}
+
+//sibling is one version of a key: its value, or a deletion of the key. The
+//write that made it is identified by a dot, the node that coordinated the
+//write and that node's counter for it, and carries the vector clock of the
+//writes it replaces (a dotted version vector). time is when the write was
+//made, by the coordinator's clock, which for a deletion is when the key was
+//deleted, and expires when the value expires, or zero if it does not.
+type sibling struct {
+	node    string
+	counter uint64
+	context clock
+	value   []byte
+	deleted bool
+	time    uint64
+	expires uint64
+}
+
+//supersedes returns true if the write of s replaced the write of o
+func (s sibling) supersedes(o sibling) bool {
+	return s.context[o.node] >= o.counter
+}
+
+func (s sibling) msg() *kvMsgs.Sibling {
+	m := new(kvMsgs.Sibling)
+	m.Node = proto.String(s.node)
+	m.Counter = proto.Uint64(s.counter)
+	m.Context = s.context.encode()
+	m.Value = s.value
+	m.Deleted = proto.Bool(s.deleted)
+	m.Time = proto.Uint64(s.time)
+	if s.expires != 0 {
+		m.Expires = proto.Uint64(s.expires)
+	}
+	return m
+}
+
+//encode returns the canonical encoding of s
+func (s sibling) encode() []byte {
+	data, err := proto.Marshal(s.msg())
+	if err != nil {
+		log.Fatal("marshaling error: ", err)
+	}
+	return data
+}
+
+//record is what a node stores for a key: the versions of the key that no
+//other version supersedes. A write replaces the versions its writer had
+//read, while versions written concurrently are kept side by side as siblings
+//until a write that has seen all of them replaces them. Merging records is
+//commutative and idempotent, so copies of a key that receive the same writes
+//in any order agree. Deleting a key stores a sibling marked as deleted, so
+//that the deletion wins over older copies of the key held elsewhere; the
+//reaper removes it once the grace period since the deletion has passed.
+type record struct {
+	siblings []sibling
+}
+
+//encode returns the record as it is kept in the storage engine
+func (rec record) encode() []byte {
+	m := new(kvMsgs.Record)
+	for _, s := range rec.siblings {
+		m.Siblings = append(m.Siblings, s.msg())
+	}
+	data, err := proto.Marshal(m)
+	if err != nil {
+		log.Fatal("marshaling error: ", err)
+	}
+	return data
+}
+
+//decodeRecord parses a record kept in the storage engine
+func decodeRecord(data []byte) (record, error) {
+	m := new(kvMsgs.Record)
+	if err := proto.Unmarshal(data, m); err != nil {
+		return record{}, err
+	}
+	var rec record
+	for _, s := range m.GetSiblings() {
+		rec.siblings = append(rec.siblings, sibling{s.GetNode(), s.GetCounter(), decodeClock(s.GetContext()), s.GetValue(), s.GetDeleted(), s.GetTime(), s.GetExpires()})
+	}
+	return rec, nil
+}
+
+//merge returns the record holding the siblings of rec and o that no other
+//sibling of either supersedes, in a canonical order
+func (rec record) merge(o record) record {
+	type dot struct {
+		node    string
+		counter uint64
+	}
+	//a dot identifies a single write, keep one sibling per dot
+	all := make(map[dot]sibling)
+	encoded := make(map[dot][]byte)
+	for _, s := range append(append([]sibling(nil), rec.siblings...), o.siblings...) {
+		d := dot{s.node, s.counter}
+		data := s.encode()
+		if old, ok := encoded[d]; !ok || bytes.Compare(data, old) > 0 {
+			all[d] = s
+			encoded[d] = data
+		}
+	}
+
+	var merged record
+	var keys [][]byte
+	for d, s := range all {
+		superseded := false
+		for e, t := range all {
+			if d != e && t.supersedes(s) {
+				superseded = true
+				break
+			}
+		}
+		if !superseded {
+			merged.siblings = append(merged.siblings, s)
+			keys = append(keys, encoded[d])
+		}
+	}
+	sort.Sort(byEncoding{merged.siblings, keys})
+	return merged
+}
+
+//byEncoding sorts siblings by their encodings
+type byEncoding struct {
+	siblings []sibling
+	keys     [][]byte
+}
+
+func (b byEncoding) Len() int           { return len(b.siblings) }
+func (b byEncoding) Less(i, j int) bool { return bytes.Compare(b.keys[i], b.keys[j]) < 0 }
+func (b byEncoding) Swap(i, j int) {
+	b.siblings[i], b.siblings[j] = b.siblings[j], b.siblings[i]
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+}
+
+//clock returns the clock that has seen every sibling of rec
+func (rec record) clock() clock {
+	c := make(clock)
+	for _, s := range rec.siblings {
+		c = c.merge(s.context).merge(clock{s.node: s.counter})
+	}
+	return c
+}
+
+//live returns the siblings that are neither deletions nor expired
+func (rec record) live() []sibling {
+	now := uint64(time.Now().UnixNano())
+	var live []sibling
+	for _, s := range rec.siblings {
+		if !s.deleted && !s.expired(now) {
+			live = append(live, s)
+		}
+	}
+	return live
+}
+
+//load returns the record stored for key
+func (kv *KV) load(key string) (rec record, ok bool, err error) {
+	e, ok, err := kv.engine.Get(key)
+	if err != nil || !ok {
+		return record{}, false, err
+	}
+	rec, err = decodeRecord(e.Value)
+	return rec, err == nil, err
+}
+
+//store merges rec into the record stored for key, and returns true if that
+//changed the stored record
+func (kv *KV) store(key string, rec record) (bool, error) {
+	kv.writeLock.Lock()
+	defer kv.writeLock.Unlock()
+	old, ok, err := kv.load(key)
+	if err != nil {
+		return false, err
+	}
+	merged := old.verified(key).merge(rec.verified(key))
+	if !ok && merged.reapable(uint64(time.Now().UnixNano()), kv.grace) {
+		//the record would be reaped right away
+		return false, nil
+	}
+	data := merged.encode()
+	if ok && bytes.Equal(data, old.encode()) {
+		return false, nil
+	}
+	return true, kv.engine.Put(kv.entry(key, data))
+}
+
+//write coordinates a new write of key on the node and returns the record of
+//the new sibling. The write supersedes the siblings ctx has seen; if ctx is
+//nil, it supersedes every sibling the node holds. If ttl is not zero, the
+//value expires after ttl.
+func (kv *KV) write(key string, value []byte, deleted bool, ttl time.Duration, ctx clock) (record, error) {
+	kv.coordLock.Lock()
+	defer kv.coordLock.Unlock()
+	return kv.writeLocked(key, value, deleted, ttl, ctx)
+}
+
+//writeLocked is write for callers that hold coordLock
+func (kv *KV) writeLocked(key string, value []byte, deleted bool, ttl time.Duration, ctx clock) (record, error) {
+	if !deleted && !valid(key, value) {
+		return record{}, ErrCorrupt
+	}
+	if ctx == nil {
+		old, _, err := kv.load(key)
+		if err != nil {
+			return record{}, err
+		}
+		ctx = old.clock()
+	}
+	s := kv.sibling(value, deleted, ctx)
+	if ttl > 0 {
+		s.expires = s.time + uint64(ttl)
+	}
+	rec := record{[]sibling{s}}
+	_, err := kv.store(key, rec)
+	return rec, err
+}
+
+//sibling returns the sibling for a new write coordinated by the node that
+//supersedes the siblings ctx has seen. Its counter is taken from the clock,
+//and is greater than any counter the node used before.
+func (kv *KV) sibling(value []byte, deleted bool, ctx clock) sibling {
+	now := uint64(time.Now().UnixNano())
+	kv.counterLock.Lock()
+	counter := now
+	if last := kv.counter; counter <= last {
+		counter = last + 1
+	}
+	if counter <= ctx[kv.node.Addr()] {
+		counter = ctx[kv.node.Addr()] + 1
+	}
+	kv.counter = counter
+	kv.counterLock.Unlock()
+	return sibling{kv.node.Addr(), counter, ctx, value, deleted, now, 0}
+}
+
+//resolve returns the value of rec: the siblings' values combined by the
+//merge function, or the value of the latest sibling if there is none. ok is
+//false if every sibling is a deletion.
+func (kv *KV) resolve(rec record) (value []byte, ok bool) {
+	live := rec.live()
+	switch {
+	case len(live) == 0:
+		return nil, false
+	case len(live) == 1:
+		return live[0].value, true
+	case kv.merge != nil:
+		values := make([][]byte, len(live))
+		for i, s := range live {
+			values[i] = s.value
+		}
+		return kv.merge(values), true
+	}
+	return latest(live).value, true
+}
+
+//latest returns the sibling written last of siblings, which must not be empty
+func latest(siblings []sibling) sibling {
+	l := siblings[0]
+	for _, s := range siblings[1:] {
+		if s.time > l.time {
+			l = s
+		}
+	}
+	return l
+}
+
+//item returns the transfer item for the stored entry e
+func item(e storage.Entry) *kvMsgs.Item {
+	it := new(kvMsgs.Item)
+	it.Key = proto.String(e.Key)
+	it.Value = e.Value
+	return it
+}
+
+//replyRecord returns the record held by the node that sent reply to a Get
+func replyRecord(reply *kvMsgs.KVMessage) (record, error) {
+	return decodeRecord(reply.GetRecord())
+}
@@ -0,0 +1,128 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"bytes"
+	"testing"
+)
+
+//newSibling returns the sibling for a write of value coordinated by node with the
+//given counter, which replaces the writes ctx has seen
+func newSibling(node string, counter uint64, value string, ctx clock) sibling {
+	return sibling{node: node, counter: counter, context: ctx, value: []byte(value), time: counter}
+}
+
+//values returns the values of the siblings of rec
+func values(rec record) map[string]bool {
+	v := make(map[string]bool)
+	for _, s := range rec.siblings {
+		v[string(s.value)] = true
+	}
+	return v
+}
+
+func TestConcurrentWritesAreSiblings(t *testing.T) {
+	base := record{[]sibling{newSibling("a", 1, "base", nil)}}
+	ctx := base.clock()
+	//two writes that both read base, coordinated by different nodes and
+	//by the same node
+	for _, nodes := range [][2]string{{"a", "b"}, {"a", "a"}} {
+		x := record{[]sibling{newSibling(nodes[0], 2, "x", ctx)}}
+		y := record{[]sibling{newSibling(nodes[1], 3, "y", ctx)}}
+		merged := base.merge(x).merge(y)
+		if v := values(merged); len(v) != 2 || !v["x"] || !v["y"] {
+			t.Errorf("writes on %s and %s read the same version: siblings %v", nodes[0], nodes[1], v)
+		}
+	}
+}
+
+func TestContextSupersedes(t *testing.T) {
+	x := newSibling("a", 1, "x", nil)
+	y := newSibling("b", 1, "y", nil)
+	z := newSibling("c", 1, "z", nil)
+	siblings := record{[]sibling{x, y, z}}
+
+	//a write that read x and y replaces them, but not z which it did not see
+	w := newSibling("a", 2, "w", record{[]sibling{x, y}}.clock())
+	merged := siblings.merge(record{[]sibling{w}})
+	if v := values(merged); len(v) != 2 || !v["w"] || !v["z"] {
+		t.Errorf("siblings after a write that read x and y: %v", v)
+	}
+
+	//a write that read every sibling replaces all of them
+	all := newSibling("b", 2, "all", merged.clock())
+	merged = merged.merge(record{[]sibling{all}})
+	if v := values(merged); len(v) != 1 || !v["all"] {
+		t.Errorf("siblings after a write that read all of them: %v", v)
+	}
+
+	//an older copy of the key merged later does not bring back what was
+	//replaced
+	if v := values(merged.merge(siblings)); len(v) != 1 || !v["all"] {
+		t.Errorf("siblings after merging an older copy: %v", v)
+	}
+
+	//a deletion supersedes what it read like any other write
+	del := newSibling("c", 2, "", merged.clock())
+	del.deleted = true
+	merged = merged.merge(record{[]sibling{del}})
+	if len(merged.siblings) != 1 || !merged.siblings[0].deleted || len(merged.live()) != 0 {
+		t.Errorf("record after a deletion: %v", merged.siblings)
+	}
+}
+
+func TestMergeCommutativeIdempotent(t *testing.T) {
+	x := newSibling("a", 1, "x", nil)
+	y := newSibling("b", 1, "y", nil)
+	z := newSibling("a", 2, "z", clock{"a": 1})
+	w := newSibling("c", 1, "w", clock{"b": 1})
+	records := []record{
+		{},
+		{[]sibling{x}},
+		{[]sibling{x, y}},
+		{[]sibling{z}},
+		{[]sibling{y, z}},
+		{[]sibling{w}},
+		{[]sibling{x, w}},
+	}
+	for i, a := range records {
+		if !bytes.Equal(a.merge(a).encode(), a.merge(record{}).encode()) {
+			t.Errorf("record %d merged with itself differs", i)
+		}
+		for j, b := range records {
+			ab, ba := a.merge(b), b.merge(a)
+			if !bytes.Equal(ab.encode(), ba.encode()) {
+				t.Errorf("merging records %d and %d depends on the order", i, j)
+			}
+			if !bytes.Equal(ab.merge(b).encode(), ab.encode()) || !bytes.Equal(ab.merge(a).encode(), ab.encode()) {
+				t.Errorf("merging records %d and %d again changes the result", i, j)
+			}
+			for k, c := range records {
+				if !bytes.Equal(ab.merge(c).encode(), a.merge(b.merge(c)).encode()) {
+					t.Errorf("merging records %d, %d and %d depends on the grouping", i, j, k)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"github.com/cbocovic/chord"
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/cbocovic/chord/storage"
+	"github.com/golang/protobuf/proto"
+)
+
+//Replicas returns the addresses of the successors that hold copies of the keys
+//the node is responsible for: the first distinct entries of its successor
+//list, up to the configured number of replicas.
+func (kv *KV) Replicas() []string {
+	var addrs []string
+	seen := map[string]bool{kv.node.Addr(): true}
+	for _, f := range kv.node.SuccessorList() {
+		if len(addrs) == kv.replicas {
+			break
+		}
+		if f.Addr() == "" || seen[f.Addr()] {
+			continue
+		}
+		seen[f.Addr()] = true
+		addrs = append(addrs, f.Addr())
+	}
+	return addrs
+}
+
+//replicate copies a write the node applied as the owner of the key to each of
+//its replicas. Failures are ignored: a replica that missed the write either
+//failed, and will be replaced by re-replication once stabilize drops it from
+//the successor list, or it will receive the write with the next one.
+func (kv *KV) replicate(msg *kvMsgs.KVMessage) {
+	if kv.replicas == 0 {
+		return
+	}
+	replica := proto.Clone(msg).(*kvMsgs.KVMessage)
+	replica.Replica = proto.Bool(true)
+	for _, addr := range kv.Replicas() {
+		kv.send(replica, addr)
+	}
+}
+
+//watch re-replicates the node's keys whenever its successor list or range
+//changes, until the subscription is closed. It then closes done. When the
+//node learns its range after it was unknown, the keys it holds outside of it
+//are migrated to its predecessors.
+//
+//The keys are copied by a worker, so that events keep being read while a
+//transfer runs instead of filling the subscription. Changes made during a
+//transfer are handled by a single round once it completes.
+func (kv *KV) watch(sub *chord.Subscription, done chan struct{}) {
+	defer close(done)
+	pending := make(chan struct{}, 1)
+	defer close(pending)
+	go func() {
+		for range pending {
+			kv.rereplicate()
+		}
+	}()
+	changed := func() {
+		select {
+		case pending <- struct{}{}:
+		default:
+			//a round is pending already
+		}
+	}
+
+	changed()
+	for e := range sub.C {
+		switch e.Type {
+		case chord.SuccessorChanged, chord.SuccessorListChanged, chord.Joined:
+			changed()
+		case chord.PredecessorChanged:
+			changed()
+			if e.Old.Addr() == "" {
+				go kv.strays(e.Peer)
+			}
+		}
+	}
+}
+
+//heldRange returns the range of keys the node keeps: the range it owns and
+//the ranges of the predecessors it holds copies for. It returns false if the
+//range is unknown, or if the node holds copies of the whole circle because
+//the ring has no more nodes than replicas of every key.
+func (kv *KV) heldRange() (chord.Range, bool) {
+	if _, ok := kv.node.OwnedRange(); !ok {
+		return chord.Range{}, false
+	}
+	list := kv.node.PredecessorList()
+	if kv.replicas >= len(list) {
+		return chord.Range{}, false
+	}
+	for _, f := range list[:kv.replicas+1] {
+		if f.Addr() == "" || f.Addr() == kv.node.Addr() {
+			return chord.Range{}, false
+		}
+	}
+	return chord.Range{Start: list[kv.replicas].ID(), End: kv.node.ID()}, true
+}
+
+//dropStale deletes the stored keys that stayed outside the range the node
+//keeps for longer than the grace period at time now. These are the copies
+//held for a predecessor the node no longer replicates, such as after a node
+//joined between them. The grace period leaves time for the routing state to
+//settle, so that copies are not dropped by a node that is about to hold them
+//again.
+func (kv *KV) dropStale(now uint64) error {
+	kv.staleLock.Lock()
+	defer kv.staleLock.Unlock()
+	held, ok := kv.heldRange()
+	if !ok {
+		kv.stale = nil
+		return nil
+	}
+	stale := make(map[string]uint64)
+	var keys []string
+	err := kv.engine.Range(chord.Range{Start: held.End, End: held.Start}, func(e storage.Entry) bool {
+		since, ok := kv.stale[e.Key]
+		if !ok {
+			since = now
+		}
+		if since+uint64(kv.grace) <= now {
+			keys = append(keys, e.Key)
+		} else {
+			stale[e.Key] = since
+		}
+		return true
+	})
+	kv.stale = stale
+	if err != nil {
+		return err
+	}
+
+	kv.writeLock.Lock()
+	defer kv.writeLock.Unlock()
+	if held, ok = kv.heldRange(); !ok {
+		return nil
+	}
+	for _, key := range keys {
+		if held.Contains(kv.entry(key, nil).ID) {
+			continue
+		}
+		if err := kv.engine.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//rereplicate copies every key the node owns to the replicas that were not
+//holding copies yet. Nothing is copied while the node's range is unknown; the
+//new replicas are found again once its predecessor is known.
+func (kv *KV) rereplicate() {
+	owned, ok := kv.node.OwnedRange()
+	if !ok {
+		return
+	}
+	kv.holdersLock.Lock()
+	old := make(map[string]bool)
+	for _, addr := range kv.holders {
+		old[addr] = true
+	}
+	kv.holders = kv.Replicas()
+	var added []string
+	for _, addr := range kv.holders {
+		if !old[addr] {
+			added = append(added, addr)
+		}
+	}
+	kv.holdersLock.Unlock()
+
+	if len(added) > 0 {
+		kv.push(added, []chord.Range{owned})
+	}
+}
+
+//RangeChanged is called when the range of keys the node is responsible for
+//changes. Keys in ranges the node lost are migrated to the new predecessor
+//that took them over. When the predecessor fails, the node already holds
+//copies of the keys it takes over; they are promoted by copying them to the
+//node's own replicas.
+func (kv *KV) RangeChanged(change chord.RangeChange) {
+	if len(change.Lost) > 0 {
+		go kv.migrate(change.Lost, change.To)
+	}
+	if kv.replicas > 0 && len(change.Gained) > 0 {
+		go kv.push(kv.Replicas(), change.Gained)
+	}
+}
+
+//push copies the stored keys in ranges to each of addrs, giving up on the ones
+//that stop being replicas of the node
+func (kv *KV) push(addrs []string, ranges []chord.Range) {
+	for _, addr := range addrs {
+		t := &transfer{addr: addr, ranges: ranges, replica: true}
+		kv.retry(t, func() bool {
+			for _, replica := range kv.Replicas() {
+				if replica == addr {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
@@ -0,0 +1,197 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"github.com/cbocovic/chord"
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/cbocovic/chord/storage"
+	"github.com/golang/protobuf/proto"
+	"time"
+)
+
+//Default settings of the reaper unless WithReaper is given.
+const (
+	DefaultReapInterval = 10 * time.Second
+	DefaultExpiryGrace  = 10 * time.Minute
+)
+
+//WithReaper sets the interval between the rounds of the reaper, which removes
+//the keys whose values expired or were deleted from the node's storage
+//engine, and how long after expiring or being deleted they are kept. Expired
+//values and deletions are never returned, but are kept for grace so that
+//anti-entropy does not bring back the values they replaced from a replica
+//that missed the write; grace should exceed the interval of anti-entropy. An
+//interval of zero disables the background rounds, leaving Reap to the
+//application. The reaper also drops the copies the node held for other nodes
+//once they have stayed outside the ranges it replicates for grace.
+func WithReaper(interval time.Duration, grace time.Duration) Option {
+	return func(kv *KV) {
+		if interval >= 0 {
+			kv.reapInterval = interval
+		}
+		if grace >= 0 {
+			kv.grace = grace
+		}
+	}
+}
+
+//PutWithTTL stores value under key like Put, and makes it expire after ttl
+//unless it is refreshed.
+func (kv *KV) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Put.Enum()
+	msg.Key = proto.String(key)
+	msg.Value = value
+	msg.Ttl = proto.Uint64(uint64(ttl))
+	_, err := kv.route(msg)
+	return err
+}
+
+//Refresh extends the lifetime of the values stored under key so that they
+//expire no earlier than ttl from now. Values that do not expire are left as
+//they are. If there is no value, the error is ErrNotFound.
+func (kv *KV) Refresh(key string, ttl time.Duration) error {
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Refresh.Enum()
+	msg.Key = proto.String(key)
+	msg.Ttl = proto.Uint64(uint64(ttl))
+	reply, err := kv.route(msg)
+	if err != nil {
+		return err
+	}
+	if !reply.GetFound() {
+		return ErrNotFound
+	}
+	return nil
+}
+
+//expired returns true if the value of s expired at time now
+func (s sibling) expired(now uint64) bool {
+	return s.expires != 0 && s.expires <= now
+}
+
+//reapable returns true if every sibling of rec is a deletion made, or a value
+//that expired, more than grace before now
+func (rec record) reapable(now uint64, grace time.Duration) bool {
+	if len(rec.siblings) == 0 {
+		return false
+	}
+	for _, s := range rec.siblings {
+		switch {
+		case s.deleted:
+			if s.time+uint64(grace) > now {
+				return false
+			}
+		case s.expires == 0 || s.expires+uint64(grace) > now:
+			return false
+		}
+	}
+	return true
+}
+
+//refresh coordinates the refresh of key on the node as the owner of the key.
+//Every live value that expires earlier than ttl from now is written again
+//with the new expiry, replacing only the sibling it was read from, so that
+//concurrent values remain siblings. It returns the record of the new
+//siblings, and false if the key has no live value.
+func (kv *KV) refresh(key string, ttl time.Duration) (record, bool, error) {
+	kv.coordLock.Lock()
+	defer kv.coordLock.Unlock()
+	old, _, err := kv.load(key)
+	if err != nil {
+		return record{}, false, err
+	}
+	live := old.live()
+	if len(live) == 0 {
+		return record{}, false, nil
+	}
+	var rec record
+	expires := uint64(time.Now().Add(ttl).UnixNano())
+	for _, s := range live {
+		if s.expires == 0 || s.expires >= expires {
+			continue
+		}
+		r := kv.sibling(s.value, false, s.context.merge(clock{s.node: s.counter}))
+		//keep the time of the write, which orders the values
+		r.time, r.expires = s.time, expires
+		rec.siblings = append(rec.siblings, r)
+	}
+	_, err = kv.store(key, rec)
+	return rec, true, err
+}
+
+//reaper reaps the node's expired keys every interval until done is closed
+func (kv *KV) reaper(done chan struct{}) {
+	ticker := time.NewTicker(kv.reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			kv.Reap()
+		}
+	}
+}
+
+//Reap removes the keys whose values all expired or were deleted longer ago
+//than the grace period from the node's storage engine, both the keys the node
+//owns and the copies it holds for other nodes. It also removes the copies of
+//keys the node no longer replicates once the grace period has passed. It
+//returns the first error encountered.
+func (kv *KV) Reap() error {
+	return kv.reapAt(uint64(time.Now().UnixNano()))
+}
+
+//reapAt reaps the keys that can be reaped at time now
+func (kv *KV) reapAt(now uint64) error {
+	var keys []string
+	//the range from an identifier to itself covers the whole ring
+	err := kv.engine.Range(chord.Range{}, func(e storage.Entry) bool {
+		if rec, err := decodeRecord(e.Value); err == nil && rec.reapable(now, kv.grace) {
+			keys = append(keys, e.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := kv.reap(key, now); err != nil {
+			return err
+		}
+	}
+	return kv.dropStale(now)
+}
+
+//reap removes key if it can still be reaped at time now
+func (kv *KV) reap(key string, now uint64) error {
+	kv.writeLock.Lock()
+	defer kv.writeLock.Unlock()
+	rec, ok, err := kv.load(key)
+	if err != nil || !ok || !rec.reapable(now, kv.grace) {
+		return err
+	}
+	return kv.engine.Delete(key)
+}
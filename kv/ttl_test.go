@@ -0,0 +1,75 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReapTombstones(t *testing.T) {
+	grace := time.Minute
+	_, stores := newRing(t, 19120, 2, WithReplicas(1), WithReaper(0, grace))
+	if err := stores[0].Put("gone", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[0].Put("kept", []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[1].Delete("gone"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stores[0].Get("gone"); err != ErrNotFound {
+		t.Fatalf("Get of a deleted key: %v", err)
+	}
+
+	//the deletion is kept on both nodes during the grace period
+	now := time.Now()
+	for i, kv := range stores {
+		if err := kv.reapAt(uint64(now.UnixNano())); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, _ := kv.engine.Get("gone"); !ok {
+			t.Errorf("node %d reaped the deletion during the grace period", i)
+		}
+	}
+
+	later := now.Add(grace + time.Second)
+	for i, kv := range stores {
+		if err := kv.reapAt(uint64(later.UnixNano())); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, _ := kv.engine.Get("gone"); ok {
+			t.Errorf("node %d kept the deletion after the grace period", i)
+		}
+		if _, ok, _ := kv.engine.Get("kept"); !ok {
+			t.Errorf("node %d reaped a live key", i)
+		}
+	}
+	if _, err := stores[0].Get("gone"); err != ErrNotFound {
+		t.Errorf("Get of a reaped key: %v", err)
+	}
+	if value, err := stores[1].Get("kept"); err != nil || string(value) != "y" {
+		t.Errorf("Get of a live key = %q, %v", value, err)
+	}
+}
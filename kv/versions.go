@@ -0,0 +1,92 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package kv
+
+import (
+	"github.com/cbocovic/chord/kv/internal"
+	"github.com/golang/protobuf/proto"
+)
+
+//MergeFunc combines the values concurrent writes left for a key into one.
+type MergeFunc func(siblings [][]byte) []byte
+
+//WithMerge sets the function that Get and QuorumGet combine the values left by
+//concurrent writes with. Without one, they return the value written last.
+func WithMerge(merge MergeFunc) Option {
+	return func(kv *KV) {
+		kv.merge = merge
+	}
+}
+
+//Context is the causal history of the values returned by GetSiblings. A
+//write made with the context replaces those values, while the values written
+//concurrently by others are kept as siblings.
+type Context struct {
+	clock clock
+}
+
+//GetSiblings returns every value concurrent writes left for key, and the
+//context to write the value that replaces them with. A deletion concurrent
+//with a write does not hide the written value. If there is no value, the
+//error is ErrNotFound, and the context may still be used to write one.
+func (kv *KV) GetSiblings(key string) ([][]byte, Context, error) {
+	rec, err := kv.get(key)
+	if err != nil {
+		return nil, Context{}, err
+	}
+	ctx := Context{rec.clock()}
+	live := rec.live()
+	if len(live) == 0 {
+		return nil, ctx, ErrNotFound
+	}
+	values := make([][]byte, len(live))
+	for i, s := range live {
+		values[i] = s.value
+	}
+	return values, ctx, nil
+}
+
+//PutWithContext stores value under key, replacing the values ctx was read
+//with. Values written concurrently by others remain as siblings.
+func (kv *KV) PutWithContext(key string, value []byte, ctx Context) error {
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Put.Enum()
+	msg.Key = proto.String(key)
+	msg.Value = value
+	msg.Context = ctx.clock.encode()
+	msg.Versioned = proto.Bool(true)
+	_, err := kv.route(msg)
+	return err
+}
+
+//DeleteWithContext deletes the values of key ctx was read with. Values
+//written concurrently by others remain.
+func (kv *KV) DeleteWithContext(key string, ctx Context) error {
+	msg := new(kvMsgs.KVMessage)
+	msg.Cmd = kvMsgs.KVMessage_Delete.Enum()
+	msg.Key = proto.String(key)
+	msg.Context = ctx.clock.encode()
+	msg.Versioned = proto.Bool(true)
+	_, err := kv.route(msg)
+	return err
+}
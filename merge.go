@@ -0,0 +1,163 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"math/rand"
+)
+
+//maxRemembered bounds the number of former peers a node remembers
+const maxRemembered = 64
+
+//remember records a peer the node has seen in its routing state. Remembered
+//peers are probed to detect partitions of the ring after they have been
+//dropped from the finger table and successor list.
+func (node *ChordNode) remember(f Finger) {
+	if f.zero() || f.ipaddr == node.ipaddr {
+		return
+	}
+	node.peersLock.Lock()
+	defer node.peersLock.Unlock()
+	if _, ok := node.peers[f.ipaddr]; !ok && len(node.peers) >= maxRemembered {
+		//forget an arbitrary peer to make room
+		for addr := range node.peers {
+			delete(node.peers, addr)
+			break
+		}
+	}
+	node.peers[f.ipaddr] = f
+}
+
+//remembered returns the addresses of the node's seeds and remembered peers
+func (node *ChordNode) remembered() []string {
+	node.peersLock.Lock()
+	defer node.peersLock.Unlock()
+	addrs := make([]string, 0, len(node.seeds)+len(node.peers))
+	for _, seed := range node.seeds {
+		if _, ok := node.peers[seed]; !ok && seed != node.ipaddr {
+			addrs = append(addrs, seed)
+		}
+	}
+	for addr := range node.peers {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+//checkPartition probes a random remembered peer. If looking up the peer's
+//identifier in the node's ring does not lead back to the peer, the two may
+//belong to different rings. A lookup can also miss while the ring is still
+//settling, so the peer is probed again by the next check, and a merge is
+//started from both sides only if the lookup misses twice in a row.
+func (node *ChordNode) checkPartition() {
+	node.peersLock.Lock()
+	addr := node.suspect
+	node.suspect = ""
+	node.peersLock.Unlock()
+	again := addr != ""
+	if !again {
+		addrs := node.remembered()
+		if len(addrs) == 0 {
+			return
+		}
+		addr = addrs[rand.Intn(len(addrs))]
+	}
+
+	msg := getidMsg()
+	reply, err := node.send(msg, addr)
+	if err != nil {
+		//peer is unreachable, nothing to merge with
+		return
+	}
+	peer := new(Finger)
+	peer.id, err = parseId(reply)
+	if err != nil {
+		return
+	}
+	peer.ipaddr = addr
+
+	successor := node.Successor()
+	if !successor.zero() {
+		owner, err := node.lookup(peer.id, successor.ipaddr)
+		if err != nil || owner == peer.ipaddr {
+			return
+		}
+	}
+
+	if !again {
+		node.peersLock.Lock()
+		node.suspect = addr
+		node.peersLock.Unlock()
+		return
+	}
+
+	//the peer is in another ring
+	node.mlookup(*peer)
+	me := new(Finger)
+	me.id = node.id
+	me.ipaddr = node.ipaddr
+	msg = mergeMsg(*me, node.bits)
+	node.send(msg, peer.ipaddr)
+}
+
+//mlookup merges the node cand from another ring into this ring. The merge
+//request is routed to the node that precedes cand; that node adopts cand as
+//its successor and asks cand to merge its previous successor in turn, so that
+//the two rings are zipped together. Stabilization then repairs predecessors
+//and finger tables.
+func (node *ChordNode) mlookup(cand Finger) {
+	if cand.zero() || cand.ipaddr == node.ipaddr || cand.id == node.id {
+		return
+	}
+	successor := node.Successor()
+	if successor.zero() {
+		//the node is alone, adopt cand as its successor
+		node.setSuccessor(cand)
+		return
+	}
+	if cand.ipaddr == successor.ipaddr {
+		//already merged
+		return
+	}
+	if InRange(cand.id, node.id, successor.id) {
+		node.setSuccessor(cand)
+		msg := mergeMsg(successor, node.bits)
+		node.send(msg, cand.ipaddr)
+		return
+	}
+
+	//forward to the closest preceding finger
+	fingers := node.Fingers()
+	for i := len(fingers) - 1; i > 0; i-- {
+		f := fingers[i]
+		if f.zero() || f.ipaddr == node.ipaddr {
+			continue
+		}
+		if InRange(f.id, node.id, cand.id) {
+			msg := mergeMsg(cand, node.bits)
+			if _, err := node.send(msg, f.ipaddr); err == nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"testing"
+)
+
+func TestPartitionConfirmed(t *testing.T) {
+	addrs := testAddrs(19260, 2, 8)
+	a := Create(addrs[0], testOptions(8)...)
+	defer a.Finalize()
+	b := Create(addrs[1], testOptions(8)...)
+	defer b.Finalize()
+	a.remember(b.Fingers()[0])
+
+	//a single probe that misses only makes the peer a suspect
+	a.checkPartition()
+	if !a.Successor().zero() {
+		t.Fatalf("merged with %s after a single probe", a.Successor())
+	}
+	if a.suspect != b.ipaddr {
+		t.Fatalf("suspect = %q, want %s", a.suspect, b.ipaddr)
+	}
+
+	a.checkPartition()
+	if a.Successor().ipaddr != b.ipaddr {
+		t.Fatalf("successor = %s after a second probe, want %s", a.Successor(), b.ipaddr)
+	}
+	nodes := []*ChordNode{a, b}
+	converge(t, nodes)
+	checkRing(t, nodes)
+}
+
+func TestPartitionSameRing(t *testing.T) {
+	addrs := testAddrs(19265, 2, 8)
+	a := Create(addrs[0], testOptions(8)...)
+	defer a.Finalize()
+	b, err := Join(addrs[1], []string{addrs[0]}, testOptions(8)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Finalize()
+	nodes := []*ChordNode{a, b}
+	converge(t, nodes)
+
+	for i := 0; i < 3; i++ {
+		a.checkPartition()
+		if a.suspect != "" {
+			t.Fatalf("suspect = %q in a single ring", a.suspect)
+		}
+	}
+	checkRing(t, nodes)
+}
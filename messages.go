@@ -28,6 +28,7 @@
 package chord
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"github.com/cbocovic/chord/internal"
 	"github.com/golang/protobuf/proto"
@@ -57,7 +58,7 @@ func getfingersMsg() []byte {
 	return data
 }
 
-func sendfingersMsg(fingers []Finger) []byte {
+func sendfingersMsg(fingers []Finger, bits int) []byte {
 
 	msg := new(chordMsgs.NetworkMessage)
 	msg.Proto = proto.Uint32(1)
@@ -68,11 +69,12 @@ func sendfingersMsg(fingers []Finger) []byte {
 	for _, finger := range fingers {
 		if !finger.zero() {
 			fingerMsg := new(chordMsgs.FingerMessage)
-			fingerMsg.Id = proto.String(string(finger.id[:32]))
+			fingerMsg.Id = proto.String(encodeId(finger.id, bits))
 			fingerMsg.Address = proto.String(finger.ipaddr)
 			sfMsg.Fingers = append(sfMsg.Fingers, fingerMsg)
 		}
 	}
+	sfMsg.Bits = proto.Uint32(uint32(bits))
 	chordMsg.Sfmsg = sfMsg
 	chorddata, err := proto.Marshal(chordMsg)
 	if err != nil {
@@ -111,7 +113,7 @@ func getidMsg() []byte {
 }
 
 //sendidMsg constructs a message to ask a server for its chord id
-func sendidMsg(id []byte) []byte {
+func sendidMsg(id [sha256.Size]byte, bits int) []byte {
 
 	msg := new(chordMsgs.NetworkMessage)
 	msg.Proto = proto.Uint32(1)
@@ -119,7 +121,7 @@ func sendidMsg(id []byte) []byte {
 	command := chordMsgs.ChordMessage_Command(chordMsgs.ChordMessage_Command_value["GetId"])
 	chordMsg.Cmd = &command
 	sidMsg := new(chordMsgs.SendIdMessage)
-	sidMsg.Id = proto.String(string(id))
+	sidMsg.Id = proto.String(encodeId(id, bits))
 	chordMsg.Sidmsg = sidMsg
 	chorddata, err := proto.Marshal(chordMsg)
 	if err != nil {
@@ -158,7 +160,7 @@ func getpredMsg() []byte {
 }
 
 //TODO: rewrite
-func sendpredMsg(finger Finger) []byte {
+func sendpredMsg(finger Finger, bits int) []byte {
 	msg := new(chordMsgs.NetworkMessage)
 	msg.Proto = proto.Uint32(1)
 	chordMsg := new(chordMsgs.ChordMessage)
@@ -166,7 +168,7 @@ func sendpredMsg(finger Finger) []byte {
 	chordMsg.Cmd = &command
 	pMsg := new(chordMsgs.PredMessage)
 	fingerMsg := new(chordMsgs.FingerMessage)
-	fingerMsg.Id = proto.String(string(finger.id[:32]))
+	fingerMsg.Id = proto.String(encodeId(finger.id, bits))
 	fingerMsg.Address = proto.String(finger.ipaddr)
 	pMsg.Pred = fingerMsg
 	chordMsg.Cpmsg = pMsg
@@ -186,7 +188,7 @@ func sendpredMsg(finger Finger) []byte {
 	return data
 }
 
-func claimpredMsg(finger Finger) []byte {
+func claimpredMsg(finger Finger, bits int) []byte {
 	msg := new(chordMsgs.NetworkMessage)
 	msg.Proto = proto.Uint32(1)
 	chordMsg := new(chordMsgs.ChordMessage)
@@ -194,7 +196,7 @@ func claimpredMsg(finger Finger) []byte {
 	chordMsg.Cmd = &command
 	predMsg := new(chordMsgs.PredMessage)
 	fingerMsg := new(chordMsgs.FingerMessage)
-	fingerMsg.Id = proto.String(string(finger.id[:32]))
+	fingerMsg.Id = proto.String(encodeId(finger.id, bits))
 	fingerMsg.Address = proto.String(finger.ipaddr)
 	predMsg.Pred = fingerMsg
 	chordMsg.Cpmsg = predMsg
@@ -214,6 +216,36 @@ func claimpredMsg(finger Finger) []byte {
 	return data
 }
 
+//mergeMsg constructs a message asking a node to merge finger, a node from
+//another ring, into its ring
+func mergeMsg(finger Finger, bits int) []byte {
+	msg := new(chordMsgs.NetworkMessage)
+	msg.Proto = proto.Uint32(1)
+	chordMsg := new(chordMsgs.ChordMessage)
+	command := chordMsgs.ChordMessage_Command(chordMsgs.ChordMessage_Command_value["Merge"])
+	chordMsg.Cmd = &command
+	mMsg := new(chordMsgs.PredMessage)
+	fingerMsg := new(chordMsgs.FingerMessage)
+	fingerMsg.Id = proto.String(encodeId(finger.id, bits))
+	fingerMsg.Address = proto.String(finger.ipaddr)
+	mMsg.Pred = fingerMsg
+	chordMsg.Cpmsg = mMsg
+
+	chorddata, err := proto.Marshal(chordMsg)
+	if err != nil {
+		log.Fatal("marshaling error: ", err)
+	}
+	msg.Msg = proto.String(string(chorddata))
+
+	data, err := proto.Marshal(msg)
+
+	if err != nil {
+		log.Fatal("marshaling error: ", err)
+	}
+
+	return data
+}
+
 //pingMsg constructs a message to ping a server
 func pingMsg() []byte {
 
@@ -279,6 +311,70 @@ func getsuccessorsMsg() []byte {
 
 }
 
+//routingStateMsg marshals the routing state of a node to be saved to disk
+func routingStateMsg(state *routingState) []byte {
+	stateMsg := new(chordMsgs.RoutingStateMessage)
+	stateMsg.Bits = proto.Uint32(uint32(state.bits))
+	stateMsg.Pred = fingerMsg(state.predecessor, state.bits)
+	for _, finger := range state.successors {
+		stateMsg.Successors = append(stateMsg.Successors, fingerMsg(finger, state.bits))
+	}
+	for _, finger := range state.fingers {
+		stateMsg.Fingers = append(stateMsg.Fingers, fingerMsg(finger, state.bits))
+	}
+	stateMsg.Peers = state.peers
+
+	data, err := proto.Marshal(stateMsg)
+	if err != nil {
+		log.Fatal("marshaling error: ", err)
+	}
+
+	return data
+}
+
+//fingerMsg converts a finger to its protocol buffer
+func fingerMsg(finger Finger, bits int) *chordMsgs.FingerMessage {
+	fMsg := new(chordMsgs.FingerMessage)
+	fMsg.Id = proto.String(encodeId(finger.id, bits))
+	fMsg.Address = proto.String(finger.ipaddr)
+	return fMsg
+}
+
+func getpredecessorsMsg() []byte {
+	msg := new(chordMsgs.NetworkMessage)
+	msg.Proto = proto.Uint32(1)
+	chordMsg := new(chordMsgs.ChordMessage)
+	command := chordMsgs.ChordMessage_Command(chordMsgs.ChordMessage_Command_value["GetPreds"])
+	chordMsg.Cmd = &command
+	chorddata, err := proto.Marshal(chordMsg)
+	if err != nil {
+		log.Fatal("marshaling error: ", err)
+	}
+	msg.Msg = proto.String(string(chorddata))
+
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		log.Fatal("marshaling error: ", err)
+	}
+
+	return data
+}
+
+//appMsg constructs a message for the application registered with the
+//identifier app
+func appMsg(app byte, data []byte) []byte {
+	msg := new(chordMsgs.NetworkMessage)
+	msg.Proto = proto.Uint32(uint32(app))
+	msg.Msg = proto.String(string(data))
+
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		log.Fatal("marshaling error: ", err)
+	}
+
+	return data
+}
+
 func nullMsg() []byte {
 	msg := new(chordMsgs.NetworkMessage)
 	msg.Proto = proto.Uint32(1)
@@ -306,8 +402,14 @@ func (node *ChordNode) parseMessage(data []byte, c chan []byte) {
 
 	protocol := msg.GetProto()
 	if protocol != 1 {
-		if app, ok := node.applications[byte(protocol)]; ok {
-			c <- app.Message([]byte(msg.GetMsg()))
+		if app, ok := node.app(byte(protocol)); ok {
+			//applications may send messages of their own while handling
+			//one, so they must not hold up the messages of other nodes
+			go func() {
+				c <- app.Message([]byte(msg.GetMsg()))
+			}()
+		} else {
+			c <- nullMsg()
 		}
 		return
 	}
@@ -327,28 +429,18 @@ func (node *ChordNode) parseMessage(data []byte, c chan []byte) {
 		c <- pongMsg()
 		return
 	case cmd == chordMsgs.ChordMessage_Command_value["GetPred"]:
-		node.request <- request{false, false, -1}
-		pred := <-node.finger
+		pred := node.Predecessor()
 		if pred.zero() {
 			c <- nullMsg()
 		} else {
-			c <- sendpredMsg(pred) //node.predecessor)
+			c <- sendpredMsg(pred, node.bits) //node.predecessor)
 		}
 		return
 	case cmd == chordMsgs.ChordMessage_Command_value["GetId"]:
-		c <- sendidMsg(node.id[:32])
+		c <- sendidMsg(node.id, node.bits)
 		return
 	case cmd == chordMsgs.ChordMessage_Command_value["GetFingers"]:
-		table := make([]Finger, 32*8+1)
-		//fmt.Printf("Fingers of node %s:\n", node.ipaddr)
-		for i := range table {
-			node.request <- request{false, false, i}
-			f := <-node.finger
-			//fmt.Printf("\t%s\n", f.String())
-			table[i] = f
-		}
-
-		c <- sendfingersMsg(table)
+		c <- sendfingersMsg(node.Fingers(), node.bits)
 		return
 	case cmd == chordMsgs.ChordMessage_Command_value["ClaimPred"]:
 		//extract finger
@@ -358,8 +450,7 @@ func (node *ChordNode) parseMessage(data []byte, c chan []byte) {
 			c <- nullMsg()
 			break
 		}
-		node.request <- request{false, false, -1}
-		pred := <-node.finger
+		pred := node.Predecessor()
 
 		if pred.zero() || InRange(newPred.id, pred.id, node.id) {
 			go node.notify(newPred)
@@ -368,24 +459,35 @@ func (node *ChordNode) parseMessage(data []byte, c chan []byte) {
 		//update finger table
 		return
 	case cmd == chordMsgs.ChordMessage_Command_value["GetSucc"]:
-		table := make([]Finger, 32*8)
-		for i := range table {
-			node.request <- request{false, true, i}
-			f := <-node.finger
-			table[i] = f
+		c <- sendfingersMsg(node.SuccessorList(), node.bits)
+		return
+	case cmd == chordMsgs.ChordMessage_Command_value["GetPreds"]:
+		c <- sendfingersMsg(node.PredecessorList(), node.bits)
+		return
+	case cmd == chordMsgs.ChordMessage_Command_value["Merge"]:
+		cand, err := parseFinger(data)
+		checkError(err)
+		if err == nil {
+			go node.mlookup(cand)
 		}
-
-		c <- sendfingersMsg(table)
+		c <- nullMsg()
 		return
 
 	}
 	fmt.Printf("No matching commands.\n")
 }
 
-//parseFingers can be called to return a finger table from a received
 //parseFingers can be called to return a finger table from a received
 //message after a getfingers call.
 func parseFingers(data []byte) (ft []Finger, err error) {
+	ft, _, err = parseFingerTable(data)
+	return
+}
+
+//parseFingerTable returns the fingers of a received message along with the
+//size of the sender's identifier space. The size is zero if the sender
+//did not include it.
+func parseFingerTable(data []byte) (ft []Finger, bits int, err error) {
 	msg := new(chordMsgs.NetworkMessage)
 	err = proto.Unmarshal(data, msg)
 	if msg.GetProto() != 1 {
@@ -404,11 +506,12 @@ func parseFingers(data []byte) (ft []Finger, err error) {
 		return
 	}
 	sfmsg := chordmsg.GetSfmsg()
+	bits = int(sfmsg.GetBits())
 	fingers := sfmsg.GetFingers()
 	prevfinger := new(Finger)
 	for _, finger := range fingers {
 		newfinger := new(Finger)
-		copy(newfinger.id[:], []byte(*finger.Id))
+		newfinger.id = decodeId(finger.GetId())
 		newfinger.ipaddr = *finger.Address
 		if !newfinger.zero() && newfinger.ipaddr != prevfinger.ipaddr {
 			ft = append(ft, *newfinger)
@@ -442,12 +545,40 @@ func parseFinger(data []byte) (f Finger, err error) {
 
 	cpmsg := chordmsg.GetCpmsg()
 	finger := cpmsg.GetPred()
-	copy(f.id[:], []byte(*finger.Id))
+	f.id = decodeId(finger.GetId())
 	f.ipaddr = *finger.Address
 
 	return
 }
 
+//parseRoutingState unmarshals a routing state saved by routingStateMsg. Unlike
+//parseFingers it keeps empty fingers so that every finger keeps its index.
+func parseRoutingState(data []byte) (state *routingState, err error) {
+	stateMsg := new(chordMsgs.RoutingStateMessage)
+	err = proto.Unmarshal(data, stateMsg)
+	if err != nil {
+		return
+	}
+	state = new(routingState)
+	state.bits = int(stateMsg.GetBits())
+	state.predecessor = parseFingerMsg(stateMsg.GetPred())
+	for _, finger := range stateMsg.GetSuccessors() {
+		state.successors = append(state.successors, parseFingerMsg(finger))
+	}
+	for _, finger := range stateMsg.GetFingers() {
+		state.fingers = append(state.fingers, parseFingerMsg(finger))
+	}
+	state.peers = stateMsg.GetPeers()
+	return
+}
+
+//parseFingerMsg converts a protocol buffer to a finger
+func parseFingerMsg(fMsg *chordMsgs.FingerMessage) (f Finger) {
+	f.id = decodeId(fMsg.GetId())
+	f.ipaddr = fMsg.GetAddress()
+	return
+}
+
 func parseId(data []byte) (id [32]byte, err error) {
 	msg := new(chordMsgs.NetworkMessage)
 	err = proto.Unmarshal(data, msg)
@@ -470,8 +601,22 @@ func parseId(data []byte) (id [32]byte, err error) {
 	}
 
 	idmsg := chordmsg.GetSidmsg()
-	arr := []byte(idmsg.GetId())
-	copy(id[:], arr[:32])
+	id = decodeId(idmsg.GetId())
+	return
+}
+
+//encodeId returns the wire encoding of an identifier: its big-endian value
+//using only as many bytes as the identifier space requires
+func encodeId(id [sha256.Size]byte, bits int) string {
+	return string(id[sha256.Size-idLen(bits):])
+}
+
+//decodeId parses an identifier encoded by encodeId
+func decodeId(data string) (id [sha256.Size]byte) {
+	if len(data) > sha256.Size {
+		data = data[len(data)-sha256.Size:]
+	}
+	copy(id[sha256.Size-len(data):], data)
 	return
 }
 
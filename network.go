@@ -23,7 +23,8 @@
 package chord
 
 import (
-	"fmt"
+	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"strconv"
@@ -64,108 +65,192 @@ func Send(msg []byte, addr string) (reply []byte, err error) {
 		return
 	}
 	defer conn.Close()
-	_, err = conn.Write(msg)
+	err = writeFrame(&conn, msg)
 	if err != nil {
 		return
 	}
 
-	reply = make([]byte, 100000) //TODO: use framing here
-	n, err := conn.Read(reply)
-	if err != nil {
-		return
-	}
-	reply = reply[:n]
-
+	reply, err = readFrame(&conn)
 	return
 
 }
 
-//send for a node checks existing open connections
+//maxFrame is the size of the largest message a node reads
+const maxFrame = 64 << 20
+
+//errFrame is returned when the length of a message is malformed or too large
+var errFrame = errors.New("bad message length")
+
+//errFinalized is returned by the sends of a node that was finalized
+var errFinalized = errors.New("node was finalized")
+
+//writeFrame writes msg to w, preceded by its length as a uvarint
+func writeFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(msg))
+	frame = append(frame[:binary.PutUvarint(frame, uint64(len(msg)))], msg...)
+	_, err := w.Write(frame)
+	return err
+}
+
+//readFrame reads a message written by writeFrame from r. The length is read
+//byte by byte, so that nothing past the message is consumed.
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [binary.MaxVarintLen64]byte
+	for i := range header {
+		if _, err := io.ReadFull(r, header[i:i+1]); err != nil {
+			return nil, err
+		}
+		if header[i] < 0x80 {
+			size, n := binary.Uvarint(header[:i+1])
+			if n <= 0 || size > maxFrame {
+				return nil, errFrame
+			}
+			msg := make([]byte, size)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return nil, err
+			}
+			return msg, nil
+		}
+	}
+	return nil, errFrame
+}
+
+//peerConn holds the open connections to a peer that are not in use. A
+//connection carries one message at a time so that replies are not
+//interleaved, so messages sent to the peer at once use connections of their
+//own: a message the peer sends back while handling one of them must not wait
+//for it to finish.
+type peerConn struct {
+	idle []net.Conn
+}
+
+//maxIdleConns is the number of unused connections kept open to each peer
+const maxIdleConns = 4
+
+//send for a node checks existing open connections. The outcome of every
+//message is recorded by the node's failure detector.
 func (node *ChordNode) send(msg []byte, addr string) (reply []byte, err error) {
 	if addr == "" {
 		err = &PeerError{addr, nil}
 		return nil, err
 	}
 
-	conn, ok := node.connections[addr]
-	if !ok {
-		//fmt.Printf("Connection from %s to %s didn't exist. Creating new...\n", node.ipaddr, addr)
-		laddr := new(net.TCPAddr)
-		laddr.IP = net.ParseIP(strings.Split(node.ipaddr, ":")[0])
-		laddr.Port = 0
-		if err != nil {
-			return
-		}
-		raddr := new(net.TCPAddr)
-		raddr.IP = net.ParseIP(strings.Split(addr, ":")[0])
-		raddr.Port, err = strconv.Atoi(strings.Split(addr, ":")[1])
+	reply, err = node.exchange(msg, addr)
+	if err != nil {
+		node.detector.failure(addr)
+	} else {
+		node.detector.reply(addr)
+	}
+	return
+}
+
+//exchange sends msg to addr over an open connection and waits for the reply
+func (node *ChordNode) exchange(msg []byte, addr string) (reply []byte, err error) {
+	select {
+	case <-node.done:
+		return nil, errFinalized
+	default:
+	}
+
+	conn := node.takeConn(addr)
+	if conn == nil {
+		conn, err = node.dial(addr)
 		if err != nil {
 			return
 		}
-		newconn, nerr := net.DialTCP("tcp", laddr, raddr)
-		if nerr != nil {
-			err = nerr
-			return
-		}
-		err = newconn.SetDeadline(time.Now().Add(3 * time.Minute))
-		checkError(err)
-		conn = *newconn
-		node.connections[addr] = conn
-		//fmt.Printf("node %s has %d connections.\n", node.ipaddr, len(node.connections))
 	}
 
-	_, err = conn.Write(msg)
-	conn.SetDeadline(time.Now().Add(3 * time.Minute))
+	conn.SetDeadline(time.Now().Add(node.config.Timeout))
+	err = writeFrame(conn, msg)
 	if err != nil {
 		//might have timed out
-		//fmt.Printf("Connection from %s to %s is no good. Creating new...\n", node.ipaddr, addr)
-		laddr := new(net.TCPAddr)
-		laddr.IP = net.ParseIP(strings.Split(node.ipaddr, ":")[0])
-		laddr.Port = 0
-
-		raddr := new(net.TCPAddr)
-		raddr.IP = net.ParseIP(strings.Split(addr, ":")[0])
-		raddr.Port, err = strconv.Atoi(strings.Split(addr, ":")[1])
+		conn.Close()
+		conn, err = node.dial(addr)
 		if err != nil {
 			return
 		}
-		newconn, nerr := net.DialTCP("tcp", laddr, raddr)
-		if nerr != nil {
-			err = nerr
-			return
-		}
-		err = newconn.SetDeadline(time.Now().Add(3 * time.Minute))
-		checkError(err)
-		conn = *newconn
-		_, err = conn.Write(msg)
+		conn.SetDeadline(time.Now().Add(node.config.Timeout))
+		err = writeFrame(conn, msg)
 		if err != nil {
+			conn.Close()
 			return
 		}
-		node.connections[addr] = conn
 	}
 
-	reply = make([]byte, 100000) //TODO: use framing here
-	n, err := conn.Read(reply)
-	conn.SetDeadline(time.Now().Add(3 * time.Minute))
+	reply, err = readFrame(conn)
 	if err != nil {
+		conn.Close()
 		return
 	}
-	reply = reply[:n]
+	node.putConn(addr, conn)
 
 	return
 
 }
 
+//takeConn returns an unused open connection to addr, or nil if there is none
+func (node *ChordNode) takeConn(addr string) net.Conn {
+	node.connLock.Lock()
+	defer node.connLock.Unlock()
+	pc, ok := node.connections[addr]
+	if !ok || len(pc.idle) == 0 {
+		return nil
+	}
+	conn := pc.idle[len(pc.idle)-1]
+	pc.idle = pc.idle[:len(pc.idle)-1]
+	return conn
+}
+
+//putConn keeps conn open for later messages to addr, unless enough
+//connections to addr are kept already or the node was finalized
+func (node *ChordNode) putConn(addr string, conn net.Conn) {
+	node.connLock.Lock()
+	defer node.connLock.Unlock()
+	select {
+	case <-node.done:
+		conn.Close()
+		return
+	default:
+	}
+	pc, ok := node.connections[addr]
+	if !ok {
+		pc = new(peerConn)
+		node.connections[addr] = pc
+	}
+	if len(pc.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	pc.idle = append(pc.idle, conn)
+}
+
+//dial opens a new connection from the node to addr
+func (node *ChordNode) dial(addr string) (net.Conn, error) {
+	laddr := new(net.TCPAddr)
+	laddr.IP = net.ParseIP(strings.Split(node.ipaddr, ":")[0])
+	laddr.Port = 0
+	dialer := net.Dialer{LocalAddr: laddr, Timeout: node.config.Timeout}
+	return dialer.Dial("tcp", addr)
+}
+
+//request is a message received on a connection, and the channel its reply is
+//sent back on
+type request struct {
+	data  []byte
+	reply chan []byte
+}
+
 //Listens at an address for incoming messages
 func (node *ChordNode) listen(addr string) {
-	fmt.Printf("Chord node %x is listening on %s...\n", node.id, addr)
-	c := make(chan []byte)
-	c2 := make(chan []byte)
+	c := make(chan request)
 	go func() {
-		defer fmt.Printf("No longer listening...\n")
 		for {
-			message := <-c
-			node.parseMessage(message, c2)
+			select {
+			case req := <-c:
+				node.parseMessage(req.data, req.reply)
+			case <-node.done:
+				return
+			}
 		}
 	}()
 
@@ -175,14 +260,21 @@ func (node *ChordNode) listen(addr string) {
 	laddr.Port, _ = strconv.Atoi(strings.Split(addr, ":")[1])
 	listener, err := net.ListenTCP("tcp", laddr)
 	checkError(err)
+	node.connLock.Lock()
+	node.listener = listener
+	node.connLock.Unlock()
 	go func() {
-		defer fmt.Printf("No longer listening...\n")
 		for {
 			if conn, err := listener.AcceptTCP(); err == nil {
 				err = conn.SetDeadline(time.Now().Add(3 * time.Minute))
 				checkError(err)
-				go handleMessage(conn, c, c2)
+				go node.handleMessage(conn, c)
 			} else {
+				select {
+				case <-node.done:
+					return
+				default:
+				}
 				checkError(err)
 				continue
 			}
@@ -190,42 +282,83 @@ func (node *ChordNode) listen(addr string) {
 	}()
 }
 
-func handleMessage(conn net.Conn, c chan []byte, c2 chan []byte) {
+func (node *ChordNode) handleMessage(conn net.Conn, c chan request) {
 
 	//Close conenction when function exits
 	defer conn.Close()
+	if !node.track(conn) {
+		return
+	}
+	defer node.untrack(conn)
+	reply := make(chan []byte, 1)
 	for {
 
-		//Create data buffer of type byte slice
-		data := make([]byte, 100000) //TODO: use framing here
 		err := conn.SetDeadline(time.Now().Add(3 * time.Minute))
-		n, err := conn.Read(data)
-		if n >= 4095 {
-			fmt.Printf("Ran out of buffer room.\n")
-		}
+		data, err := readFrame(conn)
 		if err == io.EOF { //exit cleanly
 			return
 		}
-		if err != nil {
-			//fmt.Printf("Uh oh in handle message.\n")
-			//checkError(err)
+		if err != nil { //the peer went away or the connection timed out
 			return
 		}
 
-		c <- data[:n]
+		select {
+		case c <- request{data, reply}:
+		case <-node.done:
+			return
+		}
 
 		//wait for message to come back
-		response := <-c2
+		response := <-reply
 
 		err = conn.SetDeadline(time.Now().Add(3 * time.Minute))
-		n, err = conn.Write(response)
+		err = writeFrame(conn, response)
 		if err != nil {
-			fmt.Printf("Uh oh (3).. ")
 			checkError(err)
 			return
 		}
-		if n > 100000 {
-			fmt.Printf("Uh oh. Wrote %d bytes.\n", n)
-		}
 	}
 }
+
+//track records conn as a connection the node accepted. It returns false if
+//the node was finalized.
+func (node *ChordNode) track(conn net.Conn) bool {
+	node.connLock.Lock()
+	defer node.connLock.Unlock()
+	select {
+	case <-node.done:
+		return false
+	default:
+	}
+	node.inbound[conn] = true
+	return true
+}
+
+//untrack forgets a connection the node accepted once it is closed
+func (node *ChordNode) untrack(conn net.Conn) {
+	node.connLock.Lock()
+	defer node.connLock.Unlock()
+	delete(node.inbound, conn)
+}
+
+//stop closes the node's listener and every one of its connections, and ends
+//its maintenance loops
+func (node *ChordNode) stop() {
+	node.stopOnce.Do(func() {
+		close(node.done)
+		node.connLock.Lock()
+		defer node.connLock.Unlock()
+		if node.listener != nil {
+			node.listener.Close()
+		}
+		for conn := range node.inbound {
+			conn.Close()
+		}
+		for _, pc := range node.connections {
+			for _, conn := range pc.idle {
+				conn.Close()
+			}
+		}
+		node.connections = make(map[string]*peerConn)
+	})
+}
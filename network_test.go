@@ -0,0 +1,64 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	var buf bytes.Buffer
+	sizes := []int{0, 1, 127, 128, 4095, 100000, 1 << 20}
+	for _, size := range sizes {
+		if err := writeFrame(&buf, bytes.Repeat([]byte{byte(size)}, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, size := range sizes {
+		msg, err := readFrame(&buf)
+		if err != nil {
+			t.Fatalf("reading message of %d bytes: %s", size, err)
+		}
+		if !bytes.Equal(msg, bytes.Repeat([]byte{byte(size)}, size)) {
+			t.Errorf("message of %d bytes read as %d bytes", size, len(msg))
+		}
+	}
+	if _, err := readFrame(&buf); err != io.EOF {
+		t.Errorf("read past the last message: %v", err)
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	header := make([]byte, binary.MaxVarintLen64)
+	header = header[:binary.PutUvarint(header, maxFrame+1)]
+	if _, err := readFrame(bytes.NewReader(header)); err != errFrame {
+		t.Errorf("oversized message: %v", err)
+	}
+	truncated := append([]byte{10}, make([]byte, 5)...)
+	if _, err := readFrame(bytes.NewReader(truncated)); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated message: %v", err)
+	}
+}
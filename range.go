@@ -0,0 +1,133 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+//Range is the arc (Start, End] of the identifier circle: the identifiers that
+//follow Start, up to and including End. A range whose Start and End are equal
+//covers the whole circle.
+type Range struct {
+	Start ID
+	End   ID
+}
+
+//Contains returns true if id lies in the range.
+func (r Range) Contains(id ID) bool {
+	return r.Start == r.End || id == r.End || InRange(id, r.Start, r.End)
+}
+
+//RangeChange describes how the range of keys a node is responsible for
+//changed when its predecessor changed.
+type RangeChange struct {
+	Old Range
+	New Range
+	//Gained holds the ranges the node became responsible for, and From
+	//is the former predecessor that was responsible for them.
+	Gained []Range
+	From   Finger
+	//Lost holds the ranges the node is no longer responsible for, and To is
+	//the new predecessor that took them over.
+	Lost []Range
+	To   Finger
+}
+
+//RangeApp is implemented by applications that need to know exactly which keys
+//their node gains or loses, for example to migrate stored data. If an
+//application registered with Register implements RangeApp, RangeChanged is
+//called every time the node's predecessor changes.
+type RangeApp interface {
+	ChordApp
+	RangeChanged(change RangeChange)
+}
+
+//OwnedRange returns the range of keys the node is responsible for: the keys
+//that follow its predecessor up to and including its own identifier. A node
+//that is alone on the ring is responsible for the whole identifier circle. If
+//the node has a successor but its predecessor is unknown, for example right
+//after it joined, its range is unknown and ok is false.
+func (node *ChordNode) OwnedRange() (r Range, ok bool) {
+	return node.ownedRange(node.Predecessor())
+}
+
+//Responsible returns true if the node is responsible for key. The key is
+//reduced to the ring's identifier space first, so full SHA-256 digests may be
+//used. A node whose range is unknown is not responsible for any key.
+func (node *ChordNode) Responsible(key ID) bool {
+	r, ok := node.OwnedRange()
+	return ok && r.Contains(reduce(key, node.bits))
+}
+
+//ownedRange returns the range owned by the node if its predecessor is pred
+func (node *ChordNode) ownedRange(pred Finger) (Range, bool) {
+	if !pred.zero() {
+		return Range{pred.id, node.id}, true
+	}
+	if node.Successor().zero() {
+		//alone on the ring
+		return Range{node.id, node.id}, true
+	}
+	return Range{}, false
+}
+
+//rangeChange computes how the node's range changes when its predecessor
+//changes from old to pred. Nothing is gained or lost if either range is
+//unknown: the node cannot tell which keys moved, and relies on the
+//migrations of its neighbours and on anti-entropy instead.
+func (node *ChordNode) rangeChange(old Finger, pred Finger) RangeChange {
+	var change RangeChange
+	var oldKnown, newKnown bool
+	change.Old, oldKnown = node.ownedRange(old)
+	change.New, newKnown = node.ownedRange(pred)
+	change.From = old
+	change.To = pred
+	switch {
+	case !oldKnown || !newKnown:
+	case old.zero() && pred.zero():
+	case old.zero():
+		//the whole circle shrank to (pred, me]
+		change.Lost = []Range{{node.id, pred.id}}
+	case pred.zero():
+		//(old, me] grew to the whole circle
+		change.Gained = []Range{{node.id, old.id}}
+	case old.id == pred.id:
+	case InRange(pred.id, old.id, node.id):
+		//the new predecessor joined between the old one and the node
+		change.Lost = []Range{{old.id, pred.id}}
+	default:
+		//the old predecessor left, the new one precedes it
+		change.Gained = []Range{{pred.id, old.id}}
+	}
+	return change
+}
+
+//rangeChanged tells the registered RangeApps how the node's range changed
+func (node *ChordNode) rangeChanged(old Finger, pred Finger) {
+	change := node.rangeChange(old, pred)
+	if len(change.Gained) == 0 && len(change.Lost) == 0 {
+		return
+	}
+	for _, app := range node.apps() {
+		if rapp, ok := app.(RangeApp); ok {
+			rapp.RangeChanged(change)
+		}
+	}
+}
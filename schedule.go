@@ -0,0 +1,86 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"sync"
+	"time"
+)
+
+//schedule decides how long a maintenance loop waits between rounds. A fixed
+//schedule always waits the same interval. An adaptive schedule drops to its
+//minimum interval whenever a round observes a change or failure in the
+//routing state and doubles its interval, up to its maximum, after every
+//round that observes none.
+type schedule struct {
+	lock     sync.Mutex
+	current  time.Duration
+	min      time.Duration
+	max      time.Duration
+	adaptive bool
+}
+
+func newSchedule(interval time.Duration, cfg Config) *schedule {
+	s := new(schedule)
+	s.current = interval
+	s.adaptive = cfg.Adaptive
+	if s.adaptive {
+		s.min = cfg.MinInterval
+		s.max = cfg.MaxInterval
+		if s.current < s.min {
+			s.current = s.min
+		}
+		if s.current > s.max {
+			s.current = s.max
+		}
+	}
+	return s
+}
+
+//interval returns the time to wait before the next round
+func (s *schedule) interval() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.current
+}
+
+//update adapts the schedule to the outcome of a round
+func (s *schedule) update(changed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.adaptive {
+		return
+	}
+	if changed {
+		s.current = s.min
+	} else {
+		s.current = nextBackoff(s.current, s.max)
+	}
+}
+
+//MaintenanceIntervals returns the current average times between rounds of
+//stabilization and of finger fixing. They only vary if the node was created
+//with WithAdaptiveMaintenance.
+func (node *ChordNode) MaintenanceIntervals() (stabilize time.Duration, fix time.Duration) {
+	return node.stabilizeSchedule.interval(), node.fixSchedule.interval()
+}
@@ -0,0 +1,135 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewSchedule(t *testing.T) {
+	adaptive := Config{Adaptive: true, MinInterval: time.Second, MaxInterval: 8 * time.Second}
+	tests := []struct {
+		name     string
+		interval time.Duration
+		cfg      Config
+		want     time.Duration
+	}{
+		{"fixed", 3 * time.Second, Config{}, 3 * time.Second},
+		{"fixed ignores bounds", 20 * time.Second, Config{MinInterval: time.Second, MaxInterval: 8 * time.Second}, 20 * time.Second},
+		{"within bounds", 3 * time.Second, adaptive, 3 * time.Second},
+		{"below minimum", 100 * time.Millisecond, adaptive, time.Second},
+		{"above maximum", time.Minute, adaptive, 8 * time.Second},
+	}
+	for _, test := range tests {
+		if got := newSchedule(test.interval, test.cfg).interval(); got != test.want {
+			t.Errorf("%s: interval = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestScheduleUpdate(t *testing.T) {
+	adaptive := Config{Adaptive: true, MinInterval: time.Second, MaxInterval: 8 * time.Second}
+	tests := []struct {
+		name     string
+		interval time.Duration
+		cfg      Config
+		changed  []bool
+		want     []time.Duration
+	}{
+		{
+			name:     "fixed",
+			interval: 3 * time.Second,
+			cfg:      Config{},
+			changed:  []bool{false, true, false},
+			want:     []time.Duration{3 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+		{
+			name:     "quiet rounds double up to the maximum",
+			interval: time.Second,
+			cfg:      adaptive,
+			changed:  []bool{false, false, false, false, false},
+			want:     []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second, 8 * time.Second},
+		},
+		{
+			name:     "a change or failure drops to the minimum",
+			interval: 3 * time.Second,
+			cfg:      adaptive,
+			changed:  []bool{false, true, false, true, true},
+			want:     []time.Duration{6 * time.Second, time.Second, 2 * time.Second, time.Second, time.Second},
+		},
+		{
+			name:     "doubling is clamped to the maximum",
+			interval: 5 * time.Second,
+			cfg:      adaptive,
+			changed:  []bool{false},
+			want:     []time.Duration{8 * time.Second},
+		},
+	}
+	for _, test := range tests {
+		s := newSchedule(test.interval, test.cfg)
+		for i, changed := range test.changed {
+			s.update(changed)
+			if got := s.interval(); got != test.want[i] {
+				t.Errorf("%s: interval after round %d = %v, want %v", test.name, i, got, test.want[i])
+			}
+		}
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	tests := []struct {
+		backoff, max, want time.Duration
+	}{
+		{time.Second, time.Minute, 2 * time.Second},
+		{20 * time.Second, 30 * time.Second, 30 * time.Second},
+		{30 * time.Second, 30 * time.Second, 30 * time.Second},
+		{time.Minute, 30 * time.Second, 30 * time.Second},
+	}
+	for _, test := range tests {
+		if got := nextBackoff(test.backoff, test.max); got != test.want {
+			t.Errorf("nextBackoff(%v, %v) = %v, want %v", test.backoff, test.max, got, test.want)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	tests := []struct {
+		d        time.Duration
+		j        float64
+		min, max time.Duration
+	}{
+		{time.Second, 0, time.Second, time.Second},
+		{0, 0.5, 0, 0},
+		{time.Second, 0.1, 900 * time.Millisecond, 1100 * time.Millisecond},
+		{time.Second, 0.5, 500 * time.Millisecond, 1500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		for i := 0; i < 1000; i++ {
+			got := jitter(test.d, test.j)
+			if got < test.min || got > test.max {
+				t.Fatalf("jitter(%v, %v) = %v, want within [%v, %v]", test.d, test.j, got, test.min, test.max)
+			}
+		}
+	}
+}
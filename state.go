@@ -0,0 +1,161 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+//routingState is the part of a node's state that is saved to disk so that a
+//restarted node can resume without rejoining the ring
+type routingState struct {
+	bits        int
+	predecessor Finger
+	successors  []Finger
+	fingers     []Finger
+	peers       []string
+}
+
+//routingState returns a copy of the node's routing state
+func (node *ChordNode) routingState() *routingState {
+	snapshot := node.Snapshot()
+	state := new(routingState)
+	state.bits = node.bits
+	state.predecessor = snapshot.Predecessor
+	state.successors = snapshot.Successors
+	state.fingers = snapshot.Fingers
+	state.peers = node.remembered()
+	return state
+}
+
+//saveState writes the node's routing state to its state file. The file is
+//replaced atomically so that a crash never leaves a partially written state.
+func (node *ChordNode) saveState() error {
+	state := node.routingState()
+	tmp := node.config.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, routingStateMsg(state), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, node.config.StateFile)
+}
+
+//restoreState reads the routing state saved by a previous run of the node and
+//adopts the successors, fingers and predecessor that are still alive. It
+//returns true if at least one of the saved successors is still alive, in
+//which case the node is back in the ring.
+func (node *ChordNode) restoreState() bool {
+	data, err := ioutil.ReadFile(node.config.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			checkError(err)
+		}
+		return false
+	}
+	state, err := parseRoutingState(data)
+	if err != nil {
+		checkError(err)
+		return false
+	}
+	if state.bits != node.bits {
+		//the state belongs to a ring with a different identifier space
+		return false
+	}
+
+	//only the addresses of the remembered peers are saved; the peers that
+	//still answer are remembered by the identifiers they give
+	var wg sync.WaitGroup
+	for _, addr := range state.peers {
+		if addr == "" || addr == node.ipaddr {
+			continue
+		}
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if f, ok := node.identify(addr); ok {
+				node.remember(f)
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	alive := make(map[string]bool)
+	valid := func(f Finger) bool {
+		if f.zero() || f.ipaddr == node.ipaddr {
+			return false
+		}
+		if ok, checked := alive[f.ipaddr]; checked {
+			return ok
+		}
+		alive[f.ipaddr] = node.validate(f)
+		return alive[f.ipaddr]
+	}
+
+	var successors []Finger
+	for _, f := range state.successors {
+		if valid(f) {
+			successors = append(successors, f)
+		}
+	}
+	if len(successors) == 0 {
+		return false
+	}
+	node.setSuccessor(successors[0])
+	node.setSuccessorList(successors[1:])
+
+	for i, f := range state.fingers {
+		if i < 2 || i > node.bits {
+			continue
+		}
+		if valid(f) {
+			node.setFinger(i, f)
+		}
+	}
+	if valid(state.predecessor) {
+		node.setPredecessor(state.predecessor)
+	}
+	return true
+}
+
+//validate returns true if the peer f is alive and still has the identifier
+//the node knows it by
+func (node *ChordNode) validate(f Finger) bool {
+	peer, ok := node.identify(f.ipaddr)
+	return ok && peer.id == f.id
+}
+
+//identify asks the peer at addr for its identifier. It returns false if the
+//peer does not answer.
+func (node *ChordNode) identify(addr string) (Finger, bool) {
+	msg := getidMsg()
+	reply, err := node.send(msg, addr)
+	if err != nil {
+		return Finger{}, false
+	}
+	id, err := parseId(reply)
+	if err != nil {
+		return Finger{}, false
+	}
+	return Finger{id: id, ipaddr: addr}, true
+}
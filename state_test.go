@@ -0,0 +1,151 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestorePeers(t *testing.T) {
+	addrs := testAddrs(19270, 3, 8)
+	alive := Create(addrs[0], testOptions(8)...)
+	defer alive.Finalize()
+
+	path := filepath.Join(t.TempDir(), "state")
+	state := &routingState{bits: 8, peers: []string{addrs[0], addrs[1], addrs[2]}}
+	if err := ioutil.WriteFile(path, routingStateMsg(state), 0600); err != nil {
+		t.Fatal(err)
+	}
+	node := Create(addrs[2], append(testOptions(8), WithStateFile(path))...)
+	defer node.Finalize()
+
+	node.peersLock.Lock()
+	defer node.peersLock.Unlock()
+	if len(node.peers) != 1 {
+		t.Fatalf("remembered %v, want only %s", node.peers, addrs[0])
+	}
+	if f := node.peers[addrs[0]]; f.id != alive.id {
+		t.Errorf("remembered %s as %x, want %x", addrs[0], f.id, alive.id)
+	}
+}
+
+func TestRestoreRoutingState(t *testing.T) {
+	const bits = 8
+	addrs := testAddrs(19280, 5, bits)
+	path := filepath.Join(t.TempDir(), "state")
+	nodes := []*ChordNode{Create(addrs[0], testOptions(bits)...)}
+	defer func() {
+		for _, node := range nodes {
+			node.Finalize()
+		}
+	}()
+	for i, addr := range addrs[1:] {
+		opts := testOptions(bits)
+		if i == len(addrs)-2 {
+			opts = append(opts, WithStateFile(path))
+		}
+		node, err := Join(addr, []string{addrs[0]}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	converge(t, nodes)
+	checkRing(t, nodes)
+
+	//the node saves its state when it stops and takes it back when it
+	//restarts, without contacting its seed
+	node := nodes[len(nodes)-1]
+	before := node.Snapshot()
+	node.Finalize()
+	opts := append(testOptions(bits), WithStateFile(path), WithJoinRetry(1, 0, 0))
+	node, err := Join(node.ipaddr, []string{"127.0.0.1:19289"}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes[len(nodes)-1] = node
+	select {
+	case <-node.Ready():
+	default:
+		t.Errorf("the restored node is not ready")
+	}
+	if node.Isolated() || node.Seed() != "" {
+		t.Errorf("restored node is isolated: %v, joined through %q", node.Isolated(), node.Seed())
+	}
+	after := node.Snapshot()
+	if after.Predecessor != before.Predecessor {
+		t.Errorf("restored predecessor %s, want %s", after.Predecessor, before.Predecessor)
+	}
+	if !sameFingers(after.Successors, before.Successors) {
+		t.Errorf("restored successors %v, want %v", after.Successors, before.Successors)
+	}
+	if !sameFingers(after.Fingers, before.Fingers) {
+		t.Errorf("restored fingers %v, want %v", after.Fingers, before.Fingers)
+	}
+	converge(t, nodes)
+	checkRing(t, nodes)
+}
+
+func TestRestoreFallsBackToJoin(t *testing.T) {
+	const bits = 8
+	addrs := testAddrs(19290, 5, bits)
+	nodes := []*ChordNode{Create(addrs[0], testOptions(bits)...)}
+	defer func() {
+		for _, node := range nodes {
+			node.Finalize()
+		}
+	}()
+	node, err := Join(addrs[1], []string{addrs[0]}, testOptions(bits)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes = append(nodes, node)
+	converge(t, nodes)
+
+	//none of the saved peers is listening any more
+	var gone []Finger
+	for _, addr := range addrs[3:] {
+		gone = append(gone, Finger{reduce(sha256.Sum256([]byte(addr)), bits), addr})
+	}
+	state := &routingState{bits: bits, predecessor: gone[0], successors: gone, fingers: make([]Finger, bits+1)}
+	for i := 2; i <= bits; i++ {
+		state.fingers[i] = gone[i%len(gone)]
+	}
+	path := filepath.Join(t.TempDir(), "state")
+	if err := ioutil.WriteFile(path, routingStateMsg(state), 0600); err != nil {
+		t.Fatal(err)
+	}
+	node, err = Join(addrs[2], []string{addrs[0]}, append(testOptions(bits), WithStateFile(path))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes = append(nodes, node)
+	if node.Seed() != addrs[0] {
+		t.Errorf("joined through %q, want the seed %s", node.Seed(), addrs[0])
+	}
+	converge(t, nodes)
+	checkRing(t, nodes)
+}
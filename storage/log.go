@@ -0,0 +1,419 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/cbocovic/chord"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+//ErrClosed is returned by the methods of an engine that has been closed.
+var ErrClosed = errors.New("storage engine is closed")
+
+//record operations
+const (
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+//headerLen is the length of a record header: the length of the record's
+//payload followed by its CRC-32 checksum
+const headerLen = 8
+
+//maxRecord bounds the payload length read from a log, so that a corrupted
+//header cannot make Open allocate huge buffers
+const maxRecord = 1 << 30
+
+//Log is an Engine that appends every change to a file and keeps an index of
+//the live entries in memory. Values are read from the file when they are
+//needed. Every record carries a checksum: if the node crashes while a record
+//is written, the incomplete record is discarded when the log is opened again,
+//so the log always holds a prefix of the changes that were made.
+type Log struct {
+	lock  sync.RWMutex
+	path  string
+	sync  bool
+	seg   *segment
+	size  int64
+	index *index
+}
+
+//segment is an open log file, shared by the log and its snapshots. The file
+//is closed once none of them uses it anymore.
+type segment struct {
+	f    *os.File
+	refs int32
+}
+
+func newSegment(f *os.File) *segment {
+	return &segment{f: f, refs: 1}
+}
+
+func (s *segment) acquire() {
+	atomic.AddInt32(&s.refs, 1)
+}
+
+func (s *segment) release() {
+	if atomic.AddInt32(&s.refs, -1) == 0 {
+		s.f.Close()
+	}
+}
+
+//OpenLog opens the log file at path, creating it if it does not exist, and
+//rebuilds the index from the records it holds. If sync is true, every change
+//is flushed to stable storage before it returns; otherwise changes made just
+//before a crash of the machine may be lost.
+func OpenLog(path string, sync bool) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := new(Log)
+	l.path = path
+	l.sync = sync
+	l.index = newIndex()
+	if l.size, err = replay(f, l.index); err != nil {
+		f.Close()
+		return nil, err
+	}
+	//drop whatever follows the last complete record
+	info, err := f.Stat()
+	if err == nil && info.Size() > l.size {
+		if err = f.Truncate(l.size); err == nil {
+			err = f.Sync()
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.seg = newSegment(f)
+	return l, nil
+}
+
+//replay applies the records of the log file f to x and returns the length of
+//the complete, valid records at the start of the file
+func replay(f *os.File, x *index) (int64, error) {
+	r := bufio.NewReader(f)
+	var off int64
+	header := make([]byte, headerLen)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return off, nil
+			}
+			return off, err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		if length > maxRecord {
+			return off, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return off, nil
+			}
+			return off, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return off, nil
+		}
+		op, it, ok := decodeRecord(payload)
+		if !ok {
+			return off, nil
+		}
+		switch op {
+		case opPut:
+			it.off += off + headerLen
+			x.put(it)
+		case opDelete:
+			x.remove(it.Key)
+		}
+		off += headerLen + int64(length)
+	}
+}
+
+//encodeRecord returns the record for the operation op on e, and the offset of
+//the value within it
+func encodeRecord(op byte, e Entry) ([]byte, int) {
+	var keylen [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(keylen[:], uint64(len(e.Key)))
+	payload := make([]byte, 0, 1+len(e.ID)+n+len(e.Key)+len(e.Value))
+	payload = append(payload, op)
+	payload = append(payload, e.ID[:]...)
+	payload = append(payload, keylen[:n]...)
+	payload = append(payload, e.Key...)
+	valueOff := headerLen + len(payload)
+	payload = append(payload, e.Value...)
+
+	rec := make([]byte, headerLen, headerLen+len(payload))
+	binary.BigEndian.PutUint32(rec[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(payload))
+	return append(rec, payload...), valueOff
+}
+
+//decodeRecord parses the payload of a record. The offset of the returned item
+//is relative to the start of the payload.
+func decodeRecord(payload []byte) (op byte, it *item, ok bool) {
+	it = new(item)
+	if len(payload) < 1+len(it.ID) {
+		return 0, nil, false
+	}
+	op = payload[0]
+	copy(it.ID[:], payload[1:])
+	rest := payload[1+len(it.ID):]
+	keylen, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < keylen {
+		return 0, nil, false
+	}
+	it.Key = string(rest[n : n+int(keylen)])
+	it.off = int64(len(payload) - len(rest) + n + int(keylen))
+	it.size = len(payload) - int(it.off)
+	return op, it, op == opPut || op == opDelete
+}
+
+//append writes a record for op on e to the end of the log and returns the
+//offset of the value in the file
+func (l *Log) append(op byte, e Entry) (int64, error) {
+	if l.seg == nil {
+		return 0, ErrClosed
+	}
+	rec, valueOff := encodeRecord(op, e)
+	if _, err := l.seg.f.WriteAt(rec, l.size); err != nil {
+		return 0, err
+	}
+	if l.sync {
+		if err := l.seg.f.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	off := l.size + int64(valueOff)
+	l.size += int64(len(rec))
+	return off, nil
+}
+
+func (l *Log) Get(key string) (Entry, bool, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.seg == nil {
+		return Entry{}, false, ErrClosed
+	}
+	return get(l.index, l.seg, key)
+}
+
+func (l *Log) Put(e Entry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	off, err := l.append(opPut, e)
+	if err != nil {
+		return err
+	}
+	it := new(item)
+	it.ID = e.ID
+	it.Key = e.Key
+	it.off = off
+	it.size = len(e.Value)
+	l.index.put(it)
+	return nil
+}
+
+func (l *Log) Delete(key string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.index.items[key]; !ok {
+		return nil
+	}
+	if _, err := l.append(opDelete, Entry{Key: key}); err != nil {
+		return err
+	}
+	l.index.remove(key)
+	return nil
+}
+
+func (l *Log) Range(r chord.Range, fn func(e Entry) bool) error {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.seg == nil {
+		return ErrClosed
+	}
+	return scan(l.index, l.seg, r, fn)
+}
+
+func (l *Log) Len() int {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return len(l.index.items)
+}
+
+//Snapshot returns a copy of the log's index. The records it points to are
+//never overwritten, so the snapshot reads from the same file as the log.
+func (l *Log) Snapshot() (Snapshot, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.seg == nil {
+		return nil, ErrClosed
+	}
+	l.seg.acquire()
+	return &logSnapshot{index: l.index.copy(), seg: l.seg}, nil
+}
+
+//Compact rewrites the log so that it holds only the live entries, reclaiming
+//the space of overwritten and deleted ones. The new file replaces the old one
+//atomically; open snapshots keep reading from the old file.
+func (l *Log) Compact() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.seg == nil {
+		return ErrClosed
+	}
+	tmp := l.path + ".compact"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	x := newIndex()
+	w := bufio.NewWriter(f)
+	var size int64
+	var werr error
+	err = scan(l.index, l.seg, chord.Range{}, func(e Entry) bool {
+		rec, valueOff := encodeRecord(opPut, e)
+		if _, werr = w.Write(rec); werr != nil {
+			return false
+		}
+		it := new(item)
+		it.ID = e.ID
+		it.Key = e.Key
+		it.off = size + int64(valueOff)
+		it.size = len(e.Value)
+		x.put(it)
+		size += int64(len(rec))
+		return true
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(l.path))
+
+	l.seg.release()
+	l.seg = newSegment(f)
+	l.index = x
+	l.size = size
+	return nil
+}
+
+//syncDir flushes a directory, making a rename in it durable
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+//Close closes the log. Snapshots remain readable until they are released.
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.seg == nil {
+		return ErrClosed
+	}
+	l.seg.release()
+	l.seg = nil
+	return nil
+}
+
+type logSnapshot struct {
+	index *index
+	seg   *segment
+	once  sync.Once
+}
+
+func (s *logSnapshot) Get(key string) (Entry, bool, error) {
+	return get(s.index, s.seg, key)
+}
+
+func (s *logSnapshot) Range(r chord.Range, fn func(e Entry) bool) error {
+	return scan(s.index, s.seg, r, fn)
+}
+
+func (s *logSnapshot) Len() int {
+	return len(s.index.items)
+}
+
+func (s *logSnapshot) Release() {
+	s.once.Do(s.seg.release)
+}
+
+//get returns the entry stored under key, reading its value from seg
+func get(x *index, seg *segment, key string) (Entry, bool, error) {
+	it, ok := x.items[key]
+	if !ok {
+		return Entry{}, false, nil
+	}
+	e, err := read(seg, it)
+	return e, err == nil, err
+}
+
+//scan calls fn for the entries of x in r, reading their values from seg
+func scan(x *index, seg *segment, r chord.Range, fn func(e Entry) bool) error {
+	var err error
+	x.scan(r, func(it *item) bool {
+		var e Entry
+		if e, err = read(seg, it); err != nil {
+			return false
+		}
+		return fn(e)
+	})
+	return err
+}
+
+//read returns the entry of it with its value read from seg
+func read(seg *segment, it *item) (Entry, error) {
+	e := it.Entry
+	e.Value = make([]byte, it.size)
+	if _, err := seg.f.ReadAt(e.Value, it.off); err != nil {
+		return Entry{}, err
+	}
+	return e, nil
+}
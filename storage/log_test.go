@@ -0,0 +1,189 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package storage
+
+import (
+	"github.com/cbocovic/chord"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//writeLog writes the entries to a new log at path and returns the offsets at
+//which each of their records ends
+func writeLog(t *testing.T, path string, entries []Entry) []int64 {
+	t.Helper()
+	l, err := OpenLog(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ends []int64
+	for _, e := range entries {
+		if err := l.Put(e); err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, l.size)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return ends
+}
+
+func TestLogRecovery(t *testing.T) {
+	entries := []Entry{
+		{id(1), "a", []byte("first")},
+		{id(2), "b", []byte("second")},
+		{id(3), "c", []byte("third")},
+	}
+	tests := []struct {
+		name string
+		//damage changes the log file, whose records end at ends
+		damage func(f *os.File, ends []int64) error
+		want   []string
+	}{
+		{"intact", func(*os.File, []int64) error { return nil }, []string{"a", "b", "c"}},
+		{"truncated header", func(f *os.File, ends []int64) error {
+			return f.Truncate(ends[1] + headerLen/2)
+		}, []string{"a", "b"}},
+		{"truncated payload", func(f *os.File, ends []int64) error {
+			return f.Truncate(ends[2] - 1)
+		}, []string{"a", "b"}},
+		{"bad checksum", func(f *os.File, ends []int64) error {
+			_, err := f.WriteAt([]byte{'X'}, ends[2]-1)
+			return err
+		}, []string{"a", "b"}},
+		{"bad checksum in the middle", func(f *os.File, ends []int64) error {
+			_, err := f.WriteAt([]byte{'X'}, ends[1]-1)
+			return err
+		}, []string{"a"}},
+		{"huge length", func(f *os.File, ends []int64) error {
+			_, err := f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, ends[1])
+			return err
+		}, []string{"a", "b"}},
+		{"garbage after the last record", func(f *os.File, ends []int64) error {
+			_, err := f.WriteAt([]byte{0, 0, 0, 3, 1, 2, 3, 4, 5}, ends[2])
+			return err
+		}, []string{"a", "b", "c"}},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "log")
+		ends := writeLog(t, path, entries)
+		f, err := os.OpenFile(path, os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = test.damage(f, ends)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := OpenLog(path, false)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := keys(t, l, chord.Range{}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: recovered %v, want %v", test.name, got, test.want)
+		}
+		for _, e := range entries[:len(test.want)] {
+			if got, ok, err := l.Get(e.Key); !ok || err != nil || string(got.Value) != string(e.Value) {
+				t.Errorf("%s: Get(%q) = %q, %v, %v", test.name, e.Key, got.Value, ok, err)
+			}
+		}
+		//the damaged tail is dropped, so records appended later are kept
+		if info, err := os.Stat(path); err != nil || info.Size() != ends[len(test.want)-1] {
+			t.Errorf("%s: log not truncated to its valid records", test.name)
+		}
+		l.Put(Entry{id(4), "d", []byte("fourth")})
+		l.Close()
+		if l, err = OpenLog(path, false); err != nil {
+			t.Fatal(err)
+		}
+		if got := keys(t, l, chord.Range{}); !reflect.DeepEqual(got, append(append([]string(nil), test.want...), "d")) {
+			t.Errorf("%s: after appending, recovered %v", test.name, got)
+		}
+		l.Close()
+	}
+}
+
+func TestLogCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	l, err := OpenLog(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { l.Close() }()
+	l.Put(Entry{id(1), "a", []byte("old")})
+	l.Put(Entry{id(2), "b", []byte("deleted")})
+	l.Put(Entry{id(3), "c", []byte("kept")})
+	s, err := l.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Put(Entry{id(1), "a", []byte("new")})
+	l.Delete("b")
+	before := l.size
+
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if l.size >= before {
+		t.Errorf("compaction did not shrink the log: %d bytes, was %d", l.size, before)
+	}
+	l.Put(Entry{id(4), "d", []byte("after")})
+
+	check := func(what string, e Engine) {
+		want := map[string]string{"a": "new", "c": "kept", "d": "after"}
+		if got := keys(t, e, chord.Range{}); !reflect.DeepEqual(got, []string{"a", "c", "d"}) {
+			t.Errorf("%s: lists %v", what, got)
+		}
+		for key, value := range want {
+			if got, ok, err := e.Get(key); !ok || err != nil || string(got.Value) != value {
+				t.Errorf("%s: Get(%q) = %q, %v, %v", what, key, got.Value, ok, err)
+			}
+		}
+	}
+	check("compacted log", l)
+
+	//the snapshot taken before compacting still reads the old file
+	if got := keys(t, s, chord.Range{}); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("snapshot lists %v", got)
+	}
+	for key, value := range map[string]string{"a": "old", "b": "deleted", "c": "kept"} {
+		if got, ok, err := s.Get(key); !ok || err != nil || string(got.Value) != value {
+			t.Errorf("snapshot: Get(%q) = %q, %v, %v", key, got.Value, ok, err)
+		}
+	}
+	s.Release()
+
+	l.Close()
+	if l, err = OpenLog(path, true); err != nil {
+		t.Fatal(err)
+	}
+	check("reopened log", l)
+	if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package storage
+
+import (
+	"github.com/cbocovic/chord"
+	"sync"
+)
+
+//Memory is an Engine that keeps every entry in memory.
+type Memory struct {
+	lock  sync.RWMutex
+	index *index
+}
+
+//NewMemory returns an empty Memory engine.
+func NewMemory() *Memory {
+	m := new(Memory)
+	m.index = newIndex()
+	return m
+}
+
+func (m *Memory) Get(key string) (Entry, bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.index.get(key)
+}
+
+func (m *Memory) Put(e Entry) error {
+	it := new(item)
+	it.Entry = e
+	it.Value = append([]byte(nil), e.Value...)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.index.put(it)
+	return nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.index.remove(key)
+	return nil
+}
+
+func (m *Memory) Range(r chord.Range, fn func(e Entry) bool) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.index.rangeEntries(r, fn)
+}
+
+func (m *Memory) Len() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.index.items)
+}
+
+//Snapshot returns a copy of the engine's index. Values are shared with the
+//engine, which never modifies a value once it is stored.
+func (m *Memory) Snapshot() (Snapshot, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return &memorySnapshot{m.index.copy()}, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+type memorySnapshot struct {
+	index *index
+}
+
+func (s *memorySnapshot) Get(key string) (Entry, bool, error) {
+	return s.index.get(key)
+}
+
+func (s *memorySnapshot) Range(r chord.Range, fn func(e Entry) bool) error {
+	return s.index.rangeEntries(r, fn)
+}
+
+func (s *memorySnapshot) Len() int {
+	return len(s.index.items)
+}
+
+func (s *memorySnapshot) Release() {
+	s.index = nil
+}
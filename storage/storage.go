@@ -0,0 +1,198 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+//Package storage provides the engines that applications running on a Chord
+//DHT keep their data in. Engines order entries by the identifier their key
+//maps to on the ring, so that the entries in a range of identifiers, such as
+//the range a node is responsible for, can be listed efficiently.
+package storage
+
+import (
+	"bytes"
+	"github.com/cbocovic/chord"
+	"sort"
+)
+
+//Entry is a key and its value, together with the identifier the key maps to
+//on the ring.
+type Entry struct {
+	ID    chord.ID
+	Key   string
+	Value []byte
+}
+
+//Engine stores entries on a single node. Implementations must be safe for
+//concurrent use. The values of the entries an engine returns must not be
+//modified.
+type Engine interface {
+	//Get returns the entry stored under key and whether it was found.
+	Get(key string) (e Entry, ok bool, err error)
+	//Put stores e, replacing any entry with the same key.
+	Put(e Entry) error
+	//Delete removes the entry stored under key. Deleting a missing key is
+	//not an error.
+	Delete(key string) error
+	//Range calls fn for every entry whose identifier lies in r, in order
+	//around the ring starting after r.Start, until fn returns false.
+	//Entries with the same identifier are ordered by key. The engine must not
+	//be modified from fn.
+	Range(r chord.Range, fn func(e Entry) bool) error
+	//Len returns the number of entries stored.
+	Len() int
+	//Snapshot returns a read-only view of the engine as it is now, which
+	//later writes do not change.
+	Snapshot() (Snapshot, error)
+	//Close releases the engine's resources. Snapshots remain readable
+	//until they are released.
+	Close() error
+}
+
+//Snapshot is a read-only view of an Engine at a point in time.
+type Snapshot interface {
+	Get(key string) (e Entry, ok bool, err error)
+	Range(r chord.Range, fn func(e Entry) bool) error
+	Len() int
+	//Release frees the resources held by the snapshot.
+	Release()
+}
+
+//item is an entry of an index. Engines that keep values elsewhere leave
+//Value empty and record where the value is stored.
+type item struct {
+	Entry
+	off  int64
+	size int
+}
+
+//index maps keys to items and keeps the items sorted by identifier and key.
+//Items are never modified once they are in an index, so indexes can be copied
+//cheaply.
+type index struct {
+	items  map[string]*item
+	sorted []*item
+}
+
+func newIndex() *index {
+	x := new(index)
+	x.items = make(map[string]*item)
+	return x
+}
+
+//less orders items by identifier, then by key
+func less(a *item, b *item) bool {
+	if c := bytes.Compare(a.ID[:], b.ID[:]); c != 0 {
+		return c < 0
+	}
+	return a.Key < b.Key
+}
+
+//search returns the position of it in the sorted items, or where it would be
+//inserted
+func (x *index) search(it *item) int {
+	return sort.Search(len(x.sorted), func(i int) bool {
+		return !less(x.sorted[i], it)
+	})
+}
+
+//put adds it to the index, replacing the item with the same key
+func (x *index) put(it *item) {
+	x.remove(it.Key)
+	i := x.search(it)
+	x.sorted = append(x.sorted, nil)
+	copy(x.sorted[i+1:], x.sorted[i:])
+	x.sorted[i] = it
+	x.items[it.Key] = it
+}
+
+//remove deletes the item with key from the index and returns it
+func (x *index) remove(key string) *item {
+	it, ok := x.items[key]
+	if !ok {
+		return nil
+	}
+	i := x.search(it)
+	x.sorted = append(x.sorted[:i], x.sorted[i+1:]...)
+	delete(x.items, key)
+	return it
+}
+
+//copy returns a copy of the index that later changes to x do not affect
+func (x *index) copy() *index {
+	c := new(index)
+	c.items = make(map[string]*item, len(x.items))
+	for key, it := range x.items {
+		c.items[key] = it
+	}
+	c.sorted = append([]*item(nil), x.sorted...)
+	return c
+}
+
+//after returns the position of the first item whose identifier is greater
+//than id
+func (x *index) after(id chord.ID) int {
+	return sort.Search(len(x.sorted), func(i int) bool {
+		return bytes.Compare(x.sorted[i].ID[:], id[:]) > 0
+	})
+}
+
+//scan calls fn for the items in r, in ring order, until fn returns false
+func (x *index) scan(r chord.Range, fn func(it *item) bool) {
+	start := x.after(r.Start)
+	end := x.after(r.End)
+	if bytes.Compare(r.Start[:], r.End[:]) < 0 {
+		for i := start; i < end; i++ {
+			if !fn(x.sorted[i]) {
+				return
+			}
+		}
+		return
+	}
+	//the range wraps around zero
+	for i := start; i < len(x.sorted); i++ {
+		if !fn(x.sorted[i]) {
+			return
+		}
+	}
+	for i := 0; i < end; i++ {
+		if !fn(x.sorted[i]) {
+			return
+		}
+	}
+}
+
+//get returns the entry of an index that keeps values in memory
+func (x *index) get(key string) (Entry, bool, error) {
+	it, ok := x.items[key]
+	if !ok {
+		return Entry{}, false, nil
+	}
+	return it.Entry, true, nil
+}
+
+//rangeEntries calls fn for the entries in r of an index that keeps values in
+//memory
+func (x *index) rangeEntries(r chord.Range, fn func(e Entry) bool) error {
+	x.scan(r, func(it *item) bool {
+		return fn(it.Entry)
+	})
+	return nil
+}
@@ -0,0 +1,159 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"github.com/cbocovic/chord"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//engines returns a new, empty engine of every kind
+func engines(t *testing.T) map[string]Engine {
+	t.Helper()
+	l, err := OpenLog(filepath.Join(t.TempDir(), "log"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return map[string]Engine{"memory": NewMemory(), "log": l}
+}
+
+//id returns the identifier whose last byte is b
+func id(b byte) chord.ID {
+	var x chord.ID
+	x[len(x)-1] = b
+	return x
+}
+
+//keys returns the keys of the entries of e in r, in the order Range lists
+//them
+func keys(t *testing.T, e interface {
+	Range(chord.Range, func(Entry) bool) error
+}, r chord.Range) []string {
+	t.Helper()
+	var listed []string
+	if err := e.Range(r, func(e Entry) bool {
+		listed = append(listed, e.Key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return listed
+}
+
+func TestEngineGetPutDelete(t *testing.T) {
+	for name, e := range engines(t) {
+		if _, ok, err := e.Get("a"); ok || err != nil {
+			t.Errorf("%s: Get of a missing key: %v, %v", name, ok, err)
+		}
+		e.Put(Entry{id(1), "a", []byte("1")})
+		e.Put(Entry{id(2), "b", []byte("2")})
+		e.Put(Entry{id(1), "a", []byte("3")})
+		if got, ok, err := e.Get("a"); !ok || err != nil || string(got.Value) != "3" || got.ID != id(1) {
+			t.Errorf("%s: Get of an overwritten key = %v, %v, %v", name, got, ok, err)
+		}
+		if e.Len() != 2 {
+			t.Errorf("%s: Len = %d, want 2", name, e.Len())
+		}
+		if err := e.Delete("a"); err != nil {
+			t.Errorf("%s: Delete: %v", name, err)
+		}
+		if err := e.Delete("missing"); err != nil {
+			t.Errorf("%s: Delete of a missing key: %v", name, err)
+		}
+		if _, ok, _ := e.Get("a"); ok || e.Len() != 1 {
+			t.Errorf("%s: deleted key found, Len = %d", name, e.Len())
+		}
+	}
+}
+
+func TestEngineRange(t *testing.T) {
+	tests := []struct {
+		name string
+		r    chord.Range
+		want []string
+	}{
+		{"inside", chord.Range{Start: id(10), End: id(30)}, []string{"20", "30"}},
+		{"excludes start", chord.Range{Start: id(20), End: id(40)}, []string{"30", "40a", "40b"}},
+		{"empty arc", chord.Range{Start: id(21), End: id(29)}, nil},
+		{"wraps around zero", chord.Range{Start: id(30), End: id(10)}, []string{"40a", "40b", "250", "0", "10"}},
+		{"wraps to zero", chord.Range{Start: id(40), End: id(0)}, []string{"250", "0"}},
+		{"whole circle", chord.Range{Start: id(20), End: id(20)}, []string{"30", "40a", "40b", "250", "0", "10", "20"}},
+		{"whole circle from zero", chord.Range{}, []string{"10", "20", "30", "40a", "40b", "250", "0"}},
+	}
+	for name, e := range engines(t) {
+		for _, b := range []byte{250, 40, 30, 20, 10, 0} {
+			e.Put(Entry{id(b), fmt.Sprint(b), []byte{b}})
+		}
+		//entries that share an identifier are listed by key
+		e.Delete("40")
+		e.Put(Entry{id(40), "40b", nil})
+		e.Put(Entry{id(40), "40a", nil})
+		for _, test := range tests {
+			if got := keys(t, e, test.r); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: %s: Range listed %v, want %v", name, test.name, got, test.want)
+			}
+		}
+
+		//listing stops when fn returns false
+		n := 0
+		e.Range(chord.Range{}, func(Entry) bool {
+			n++
+			return n < 3
+		})
+		if n != 3 {
+			t.Errorf("%s: Range went on for %d entries after fn returned false", name, n-3)
+		}
+	}
+}
+
+func TestEngineSnapshot(t *testing.T) {
+	for name, e := range engines(t) {
+		e.Put(Entry{id(1), "a", []byte("1")})
+		e.Put(Entry{id(2), "b", []byte("2")})
+		s, err := e.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Put(Entry{id(1), "a", []byte("changed")})
+		e.Delete("b")
+		e.Put(Entry{id(3), "c", []byte("3")})
+
+		if got, ok, _ := s.Get("a"); !ok || string(got.Value) != "1" {
+			t.Errorf("%s: snapshot sees a later write: %q", name, got.Value)
+		}
+		if _, ok, _ := s.Get("b"); !ok {
+			t.Errorf("%s: snapshot sees a later deletion", name)
+		}
+		if got := keys(t, s, chord.Range{}); !reflect.DeepEqual(got, []string{"a", "b"}) || s.Len() != 2 {
+			t.Errorf("%s: snapshot lists %v", name, got)
+		}
+		s.Release()
+		if got := keys(t, e, chord.Range{}); !reflect.DeepEqual(got, []string{"a", "c"}) {
+			t.Errorf("%s: engine lists %v", name, got)
+		}
+	}
+}
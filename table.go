@@ -0,0 +1,237 @@
+/**
+ *Copyright (c) 2018 Cecylia Bocovich
+ *
+ *Permission is hereby granted, free of charge, to any person obtaining a copy
+ *of this software and associated documentation files (the "Software"), to deal
+ *in the Software without restriction, including without limitation the rights
+ *to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ *copies of the Software, and to permit persons to whom the Software is
+ *furnished to do so, subject to the following conditions:
+
+ *The above copyright notice and this permission notice shall be included in all
+ *copies or substantial portions of the Software.
+
+ *THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ *IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ *FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ *AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ *LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ *OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ *SOFTWARE.
+ */
+
+package chord
+
+import (
+	"sync"
+)
+
+//routingTable holds a node's predecessor list, successor list and finger
+//table. The first entry of the predecessor list is the predecessor, the first
+//entry of the successor list is the successor, and the finger table holds the
+//node itself at index 0 and the successor at index 1. All access goes through
+//the lock so that readers always see a consistent state.
+type routingTable struct {
+	sync.RWMutex
+	predecessors []Finger
+	successors   []Finger
+	fingers      []Finger
+}
+
+//Snapshot is a consistent copy of a node's routing state taken at a single
+//point in time.
+type Snapshot struct {
+	//Predecessor is the node's predecessor, or a zero Finger if unknown.
+	Predecessor Finger
+	//Predecessors is the predecessor list, starting with the predecessor.
+	Predecessors []Finger
+	//Successors is the successor list, starting with the successor.
+	Successors []Finger
+	//Fingers is the finger table. Fingers[0] is the node itself and
+	//Fingers[i] is the first node that succeeds the node's id by at least
+	//2^(i-1).
+	Fingers []Finger
+}
+
+func newRoutingTable(me Finger, bits int, r int) *routingTable {
+	table := new(routingTable)
+	table.predecessors = make([]Finger, r)
+	table.successors = make([]Finger, r)
+	table.fingers = make([]Finger, bits+1)
+	table.fingers[0] = me
+	return table
+}
+
+//Snapshot returns a consistent copy of the node's predecessor, predecessor
+//list, successor list and finger table.
+func (node *ChordNode) Snapshot() Snapshot {
+	node.table.RLock()
+	defer node.table.RUnlock()
+	var s Snapshot
+	s.Predecessor = node.table.predecessors[0]
+	s.Predecessors = append([]Finger(nil), node.table.predecessors...)
+	s.Successors = append([]Finger(nil), node.table.successors...)
+	s.Fingers = append([]Finger(nil), node.table.fingers...)
+	return s
+}
+
+//sameSnapshot returns true if two snapshots hold the same routing state
+func sameSnapshot(a Snapshot, b Snapshot) bool {
+	return a.Predecessor == b.Predecessor &&
+		sameFingers(a.Predecessors, b.Predecessors) &&
+		sameFingers(a.Successors, b.Successors) &&
+		sameFingers(a.Fingers, b.Fingers)
+}
+
+//sameFingers returns true if both lists hold the same peers in the same order
+func sameFingers(a []Finger, b []Finger) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//Predecessor returns the node's predecessor, or a zero Finger if the node
+//does not know its predecessor.
+func (node *ChordNode) Predecessor() Finger {
+	node.table.RLock()
+	defer node.table.RUnlock()
+	return node.table.predecessors[0]
+}
+
+//Successor returns the node's successor, or a zero Finger if the node does
+//not know its successor.
+func (node *ChordNode) Successor() Finger {
+	node.table.RLock()
+	defer node.table.RUnlock()
+	return node.table.successors[0]
+}
+
+//finger returns the entry at index i of the finger table
+func (node *ChordNode) finger(i int) Finger {
+	node.table.RLock()
+	defer node.table.RUnlock()
+	return node.table.fingers[i]
+}
+
+//SuccessorList returns a copy of the node's successor list, starting with the
+//successor. Unknown entries are zero Fingers.
+func (node *ChordNode) SuccessorList() []Finger {
+	node.table.RLock()
+	defer node.table.RUnlock()
+	return append([]Finger(nil), node.table.successors...)
+}
+
+//PredecessorList returns a copy of the node's predecessor list, starting with
+//the predecessor. Unknown entries are zero Fingers.
+func (node *ChordNode) PredecessorList() []Finger {
+	node.table.RLock()
+	defer node.table.RUnlock()
+	return append([]Finger(nil), node.table.predecessors...)
+}
+
+//Fingers returns a copy of the node's finger table. The entry at index 0 is
+//the node itself and the entry at index i is the first node that succeeds the
+//node's identifier by at least 2^(i-1). Unknown entries are zero Fingers.
+func (node *ChordNode) Fingers() []Finger {
+	node.table.RLock()
+	defer node.table.RUnlock()
+	return append([]Finger(nil), node.table.fingers...)
+}
+
+//setPredecessor replaces the node's predecessor. Like the other setters, it
+//emits its events while holding the lock of the routing table, so that they
+//reach subscribers in the order the changes were made.
+func (node *ChordNode) setPredecessor(f Finger) {
+	node.table.Lock()
+	old := node.table.predecessors[0]
+	node.table.predecessors[0] = f
+	if old != f {
+		node.emit(Event{Type: PredecessorChanged, Peer: f, Old: old})
+	}
+	node.table.Unlock()
+	node.remember(f)
+	if old != f {
+		node.rangeChanged(old, f)
+	}
+}
+
+//setSuccessor replaces the node's successor, which is also the first finger
+func (node *ChordNode) setSuccessor(f Finger) {
+	node.table.Lock()
+	old := node.table.successors[0]
+	node.table.successors[0] = f
+	node.table.fingers[1] = f
+	if old != f {
+		list := append([]Finger(nil), node.table.successors...)
+		node.emit(Event{Type: SuccessorChanged, Peer: f, Old: old})
+		node.emit(Event{Type: FingerUpdated, Peer: f, Old: old, Index: 1})
+		node.emit(Event{Type: SuccessorListChanged, List: list})
+	}
+	node.table.Unlock()
+	node.remember(f)
+}
+
+//setFinger replaces the entry at index i of the finger table
+func (node *ChordNode) setFinger(i int, f Finger) {
+	if i == 1 {
+		node.setSuccessor(f)
+		return
+	}
+	node.table.Lock()
+	old := node.table.fingers[i]
+	node.table.fingers[i] = f
+	if old != f {
+		node.emit(Event{Type: FingerUpdated, Peer: f, Old: old, Index: i})
+	}
+	node.table.Unlock()
+	node.remember(f)
+}
+
+//setSuccessorList replaces every entry of the successor list after the
+//successor with the entries of list, in order. Entries beyond the end of
+//list are cleared.
+func (node *ChordNode) setSuccessorList(list []Finger) {
+	node.table.Lock()
+	if setList(node.table.successors, list) {
+		successors := append([]Finger(nil), node.table.successors...)
+		node.emit(Event{Type: SuccessorListChanged, List: successors})
+	}
+	node.table.Unlock()
+	for _, f := range list {
+		node.remember(f)
+	}
+}
+
+//setPredecessorList replaces every entry of the predecessor list after the
+//predecessor with the entries of list, in order. Entries beyond the end of
+//list are cleared.
+func (node *ChordNode) setPredecessorList(list []Finger) {
+	node.table.Lock()
+	setList(node.table.predecessors, list)
+	node.table.Unlock()
+	for _, f := range list {
+		node.remember(f)
+	}
+}
+
+//setList copies list into dst[1:], clearing the entries list does not cover.
+//It returns true if any entry of dst changed.
+func setList(dst []Finger, list []Finger) (changed bool) {
+	for i := 1; i < len(dst); i++ {
+		f := Finger{}
+		if i-1 < len(list) {
+			f = list[i-1]
+		}
+		if dst[i] != f {
+			dst[i] = f
+			changed = true
+		}
+	}
+	return
+}
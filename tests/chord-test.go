@@ -59,7 +59,11 @@ func main() {
 		list[0] = me
 	} else {
 		me := new(chord.ChordNode)
-		me = chord.Join(startaddr, "127.0.0.2:8888")
+		me, err := chord.Join(startaddr, []string{"127.0.0.2:8888"})
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			return
+		}
 		list[0] = me
 	}
 
@@ -73,7 +77,11 @@ func main() {
 		addr := fmt.Sprintf("127.%d.%d.%d:8888", high, middle, low)
 
 		fmt.Printf("Joining %d server starting at %s!\n", 1, addr)
-		node = chord.Join(addr, startaddr)
+		node, err := chord.Join(addr, []string{startaddr})
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			return
+		}
 		list[i] = node
 		fmt.Printf("Joined server: %s.\n", addr)
 	}
@@ -88,7 +96,7 @@ Loop:
 			//print out successors and predecessors
 			fmt.Printf("Node\t\t Successor\t\t Predecessor\n")
 			for _, node := range list {
-				fmt.Printf("%s\n", node.Info())
+				fmt.Printf("%s\n", node.String())
 			}
 		case cmd == "fingers":
 			//print out finger table